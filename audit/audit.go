@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Event types
+const (
+	EventAuth    = "auth"
+	EventInvoke  = "invoke"
+	EventPayload = "payload"
+)
+
+// Outcomes and auth decisions
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	DecisionAllow  = "allow"
+	DecisionDeny   = "deny"
+)
+
+// Event is a single audit record. It never holds request or response bodies
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"event"`
+	RequestID string    `json:"request_id,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	RemoteIP  string    `json:"remote_ip,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	CodeID    string    `json:"code_id,omitempty"`
+	CodeName  string    `json:"code_name,omitempty"`
+	// Mode is sync or async for invocations
+	Mode      string `json:"mode,omitempty"`
+	TaskID    string `json:"task_id,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	Decision  string `json:"decision,omitempty"`
+	Outcome   string `json:"outcome,omitempty"`
+	Status    int    `json:"status,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+}
+
+// Done sets the outcome and latency of an event started at start
+func (e *Event) Done(start time.Time, err error) {
+	e.LatencyMS = time.Since(start).Milliseconds()
+	e.Outcome = OutcomeSuccess
+	if err != nil {
+		e.Outcome = OutcomeFailure
+		e.Reason = err.Error()
+	}
+}
+
+// Logger writes audit events as JSON lines. A nil Logger discards events
+type Logger struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// New returns a logger writing to w
+func New(w io.Writer) *Logger {
+	return &Logger{enc: json.NewEncoder(w)}
+}
+
+// Open returns a logger for sink, which is "stdout" or the path of a file to append to
+func Open(sink string) (*Logger, error) {
+	if sink == "stdout" {
+		return New(os.Stdout), nil
+	}
+	f, err := os.OpenFile(sink, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := New(f)
+	l.closer = f
+	return l, nil
+}
+
+// Log writes an event
+func (l *Logger) Log(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&e); err != nil {
+		slog.Error("error writing audit event", "error", err)
+	}
+}
+
+// Close closes the audit log file
+func (l *Logger) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+type loggerContextKey struct{}
+
+// NewContext returns a context carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// FromContext returns the logger of ctx, or nil when there is none
+func FromContext(ctx context.Context) *Logger {
+	l, _ := ctx.Value(loggerContextKey{}).(*Logger)
+	return l
+}
+
+// Middleware stores the logger in the request context for the auth middlewares,
+// the handlers and the proxy transport. It must run before them
+func Middleware(l *Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			c.SetRequest(req.WithContext(NewContext(req.Context(), l)))
+			return next(c)
+		}
+	}
+}
+
+// Request returns an event of type describing the request of c
+func Request(c echo.Context, eventType string) Event {
+	return Event{
+		Type:      eventType,
+		RequestID: c.Request().Header.Get(echo.HeaderXRequestID),
+		RemoteIP:  c.RealIP(),
+		Method:    c.Request().Method,
+		Route:     c.Path(),
+		Path:      RedactURL(c.Request().URL),
+	}
+}
+
+// RedactURL returns the path and query of u with query values redacted, as they may hold secrets
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	query := u.Query()
+	if len(query) == 0 {
+		return u.Path
+	}
+	for key := range query {
+		query[key] = []string{"REDACTED"}
+	}
+	return u.Path + "?" + query.Encode()
+}
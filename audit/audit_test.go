@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e := echo.New()
+	e.POST("/async-function/:codeID", func(c echo.Context) error {
+		event := Request(c, EventInvoke)
+		event.CodeID = c.Param("codeID")
+		event.Done(time.Now(), errors.New("failed to spawn task"))
+		FromContext(c.Request().Context()).Log(event)
+		return c.NoContent(http.StatusAccepted)
+	}, Middleware(logger))
+	req := httptest.NewRequest(http.MethodPost, "/async-function/20?token=secret&x=1", nil)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, logger.Close())
+
+	f, err := os.Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventInvoke, events[0]["event"])
+		assert.Equal(t, "20", events[0]["code_id"])
+		assert.Equal(t, "/async-function/:codeID", events[0]["route"])
+		assert.Equal(t, "/async-function/20?token=REDACTED&x=REDACTED", events[0]["path"])
+		assert.Equal(t, OutcomeFailure, events[0]["outcome"])
+		assert.Equal(t, "failed to spawn task", events[0]["reason"])
+		assert.NotEmpty(t, events[0]["time"])
+	}
+
+	var nilLogger *Logger
+	nilLogger.Log(Event{Type: EventAuth}) // Discarded
+	assert.NoError(t, nilLogger.Close())
+}
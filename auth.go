@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/config"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+)
+
+// authChain is the auth of the gateway routes. The authenticators are built from the
+// auth configuration and swapped atomically when the configuration is reloaded
+type authChain struct {
+	current atomic.Pointer[authenticators]
+}
+
+// authenticators are tried in the configured order, with mode "all" every one of them must succeed
+type authenticators struct {
+	config     config.AuthConfig
+	tokens     *mw.TokenStore
+	stopTokens func()
+	byScope    map[string]mw.Authenticator
+	// introspect caches IAM token introspections, nil without IAM auth
+	introspect *mw.IntrospectCache
+}
+
+func newAuthChain(cfg config.AuthConfig) (*authChain, error) {
+	a := &authChain{}
+	if err := a.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload replaces the authenticators when the auth configuration changed
+func (a *authChain) Reload(cfg config.AuthConfig) error {
+	old := a.current.Load()
+	if old != nil && reflect.DeepEqual(old.config, cfg) {
+		return nil
+	}
+	next, err := newAuthenticators(cfg)
+	if err != nil {
+		return err
+	}
+	a.current.Store(next)
+	if old != nil {
+		old.stopTokens()
+	}
+	return nil
+}
+
+// Close stops watching the token store file
+func (a *authChain) Close() {
+	if current := a.current.Load(); current != nil {
+		current.stopTokens()
+	}
+}
+
+// IntrospectStats returns the counters of the IAM introspection cache, zero without IAM auth
+func (a *authChain) IntrospectStats() mw.CacheStats {
+	if current := a.current.Load(); current != nil && current.introspect != nil {
+		return current.introspect.Stats()
+	}
+	return mw.CacheStats{}
+}
+
+// For returns the auth middleware of a function route. Tokens are checked against the scope of the route
+func (a *authChain) For(scope string) echo.MiddlewareFunc {
+	return mw.Authenticate(func(c echo.Context) (*mw.Principal, error) {
+		return a.current.Load().byScope[scope](c)
+	})
+}
+
+// Tokens returns a middleware which only accepts tokens granted scope
+func (a *authChain) Tokens(scope string) echo.MiddlewareFunc {
+	return mw.Authenticate(func(c echo.Context) (*mw.Principal, error) {
+		return mw.TokenAuthenticator(a.current.Load().tokens, scope)(c)
+	})
+}
+
+func newAuthenticators(cfg config.AuthConfig) (*authenticators, error) {
+	tokens, stopTokens, err := newTokenStore(cfg.Token)
+	if err != nil {
+		return nil, fmt.Errorf("token store: %w", err)
+	}
+	var introspect *mw.IntrospectCache
+	shared := make(map[string]mw.Authenticator)
+	for _, authType := range cfg.Types {
+		if authType == config.AuthToken {
+			continue
+		}
+		if authType == config.AuthIAM {
+			introspect = mw.NewIntrospectCache(cfg.IAMCache.Size, cfg.IAMCache.TTL, cfg.IAMCache.NegativeTTL)
+		}
+		authenticator, err := newAuthenticator(cfg, authType, introspect)
+		if err != nil {
+			stopTokens()
+			return nil, fmt.Errorf("%s auth: %w", authType, err)
+		}
+		shared[authType] = authenticator
+	}
+	a := &authenticators{
+		config:     cfg,
+		tokens:     tokens,
+		stopTokens: stopTokens,
+		byScope:    make(map[string]mw.Authenticator),
+		introspect: introspect,
+	}
+	for _, scope := range mw.AllScopes {
+		var chain []mw.Authenticator
+		for _, authType := range cfg.Types {
+			if authType == config.AuthToken {
+				chain = append(chain, mw.TokenAuthenticator(tokens, scope))
+				continue
+			}
+			chain = append(chain, shared[authType])
+		}
+		if cfg.Mode == config.AuthModeAll {
+			a.byScope[scope] = mw.AllOf(chain...)
+		} else {
+			a.byScope[scope] = mw.AnyOf(chain...)
+		}
+	}
+	return a, nil
+}
+
+// newAuthenticator returns the authenticator of authType, which the configuration validated.
+// IAM tokens are introspected through introspect
+func newAuthenticator(cfg config.AuthConfig, authType string, introspect *mw.IntrospectCache) (mw.Authenticator, error) {
+	switch authType {
+	case config.AuthNone:
+		return mw.NoneAuthenticator(), nil
+	case config.AuthIAM:
+		iamConfig := cfg.IAM
+		iamConfig.Cache = introspect
+		return mw.IAMAuthenticator(iamConfig)
+	case config.AuthJWT:
+		return mw.JWTAuthenticator(cfg.JWT)
+	case config.AuthSigned:
+		return mw.SignedAuthenticator(cfg.Signed)
+	case config.AuthCert:
+		return mw.CertAuthenticator(cfg.Cert), nil
+	}
+	return nil, fmt.Errorf("unknown auth type %q", authType)
+}
+
+// newTokenStore loads the tokens of the store file, which is watched for changes, or the
+// configured tokens. The legacy token, which is shared with chisel, is granted all scopes
+func newTokenStore(cfg config.TokenConfig) (*mw.TokenStore, func(), error) {
+	tokens := mw.NewTokenStore()
+	stop := func() {}
+	var err error
+	if cfg.StoreFile != "" {
+		tokens, err = mw.LoadTokenStoreFile(cfg.StoreFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		stop = tokens.Watch(tokenStoreReloadInterval)
+	} else if len(cfg.Tokens) > 0 {
+		tokens, err = mw.NewTokenStoreWithTokens(cfg.Tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.Token != "" {
+		if err := tokens.Add("default", cfg.Token, mw.AllScopes...); err != nil {
+			stop()
+			return nil, nil, err
+		}
+	}
+	return tokens, stop, nil
+}
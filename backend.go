@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/philips-labs/ferrite/server"
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/config"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	"github.com/philips-labs/hsdp-funcion-gateway/handlers"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// backend is an Iron project or ferrite server with its own client, task transport,
+// policy resolver and crontab, so an outage of one backend does not affect the others
+type backend struct {
+	name       string
+	config     config.BackendConfig
+	client     *iron.Client
+	ironConfig *iron.Config
+	transport  *handlers.IronBackendRoundTripper
+	resolver   *policy.Resolver
+	crontab    *crontab.Crontab
+	// err is why the backend could not be set up. Its routes respond 503
+	err error
+}
+
+// newIronClient returns a client of an Iron backend. A ferrite backend is bootstrapped first,
+// which provides the project and cluster of the returned configuration
+func newIronClient(b config.BackendConfig) (*iron.Client, *iron.Config, error) {
+	ironConfig := b.Iron.Config
+	ironConfig.ClusterInfo = append([]iron.ClusterInfo(nil), b.Iron.ClusterInfo...)
+	if b.Type == config.BackendFerrite { // Need bootstrap
+		bootstrap, err := server.Bootstrap(ironConfig.BaseURL, ironConfig.Token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bootstrapping ferrite: %w", err)
+		}
+		ironConfig.ProjectID = bootstrap.ProjectID
+		ironConfig.Project = bootstrap.ProjectID
+		ironConfig.ClusterInfo[0].ClusterID = bootstrap.ClusterID
+		ironConfig.ClusterInfo[0].Pubkey = bootstrap.PublicKey
+		slog.Info("bootstrapped ferrite config", "project_id", bootstrap.ProjectID, "cluster_id", bootstrap.ClusterID)
+	}
+	client, err := iron.NewClient(&ironConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Iron client: %w", err)
+	}
+	return client, &ironConfig, nil
+}
+
+// newBackend sets up a backend. A backend which cannot be set up is returned with err set
+func newBackend(name string, b config.BackendConfig, cfg *config.Config, policies *policy.Store, multiple bool) *backend {
+	log := slog.With("backend", name)
+	be := &backend{name: name, config: b}
+	be.client, be.ironConfig, be.err = newIronClient(b)
+	if be.err != nil {
+		return be
+	}
+	if codes, _, err := be.client.Codes.GetCodes(); err == nil {
+		log.Info("connected to Iron", "project_id", be.ironConfig.ProjectID, "codes", len(*codes))
+	}
+	selector := clusters.NewSelector(be.client, be.ironConfig.ClusterInfo, b.Clusters)
+	be.transport = handlers.NewIronBackendRoundTripper(http.DefaultTransport, be.client, upstreamHost)
+	be.transport.Clusters = selector
+	be.transport.Name = name
+	be.resolver = policy.NewResolver(be.client, policies)
+
+	cronConfig := cfg.Cron
+	if multiple {
+		cronConfig.Backend = name
+	}
+	// Every crontab persists the pause state of its own schedules
+	if cronConfig.StateFile != "" && name != config.DefaultBackendName {
+		cronConfig.StateFile += "." + name
+	}
+	be.crontab = crontab.New(be.client, cronConfig)
+	be.crontab.SetClusterSelector(selector)
+	return be
+}
+
+// routes registers the function, admin and cron routes of the backend under segment,
+// "/{name}" for the namespaced routes and empty for the routes of the default backend
+func (be *backend) routes(e *echo.Echo, segment string, auth *authChain, limit echo.MiddlewareFunc, status handlers.StatusConfig) {
+	if be.err != nil {
+		unavailable := func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "backend "+be.name+" is unavailable")
+		}
+		for _, prefix := range []string{"/function", "/sync-function", "/async-function", "/admin", "/cron"} {
+			e.Any(prefix+segment, unavailable)
+			e.Any(prefix+segment+"/*", unavailable)
+		}
+		e.GET("/debug/status"+segment, unavailable)
+		return
+	}
+
+	// Reverse proxy
+	origin, _ := url.Parse("http://" + upstreamHost + "/") // Upstream
+	targets := []*middleware.ProxyTarget{
+		{
+			URL: origin,
+		},
+	}
+	balancer := middleware.NewRoundRobinBalancer(targets)
+	proxyMiddleware := middleware.ProxyWithConfig(middleware.ProxyConfig{
+		Balancer:  balancer,
+		Transport: be.transport,
+	})
+	// Policies are resolved after authentication and rate limiting
+	syncAuth := policy.Enforce(be.resolver, auth.For(mw.ScopeInvokeSync), limit)
+	asyncAuth := policy.Enforce(be.resolver, auth.For(mw.ScopeInvokeAsync), limit)
+
+	af := e.Group("/async-function"+segment, asyncAuth)
+	af.POST("/:codeID/*", handlers.Async(be.transport))
+	af.POST("/:codeID", handlers.Async(be.transport))
+
+	e.Group("/function"+segment, syncAuth, proxyMiddleware)
+	e.Group("/sync-function"+segment, syncAuth, proxyMiddleware)
+
+	// Browsing of codes, schedules and tasks
+	ag := e.Group("/admin"+segment, auth.Tokens(mw.ScopeAdmin))
+	ag.GET("/codes", handlers.AdminCodes(be.client))
+	ag.GET("/codes/:codeID", handlers.AdminCode(be.client))
+	ag.GET("/codes/:codeID/tasks", handlers.AdminTasks(be.client, be.ironConfig))
+
+	status.Name = be.name
+	status.Backend = be.config.Type
+	status.Config = be.ironConfig
+	status.Transport = be.transport
+	status.Crontab = be.crontab
+	status.Resolver = be.resolver
+	e.GET("/debug/status"+segment, handlers.DebugStatus(status), auth.Tokens(mw.ScopeAdmin))
+
+	cg := e.Group("/cron"+segment, auth.Tokens(mw.ScopeAdmin))
+	cg.GET("/entries", handlers.CronEntries(be.crontab))
+	cg.GET("/status", handlers.CronStatus(be.crontab))
+	cg.GET("/:scheduleID/history", handlers.CronHistory(be.crontab))
+	cg.POST("/:scheduleID/run", handlers.CronRun(be.crontab))
+	cg.POST("/:scheduleID/pause", handlers.CronPause(be.crontab))
+	cg.POST("/:scheduleID/resume", handlers.CronResume(be.crontab))
+}
+
+// checks returns the readiness checks of the backend. With several backends the checks
+// are named after the backend and optional, so an outage of one backend is reported
+// without taking the gateway out of service
+func (be *backend) checks(multiple bool) []handlers.ReadinessCheck {
+	var checks []handlers.ReadinessCheck
+	if be.err != nil {
+		checks = append(checks, handlers.ReadinessCheck{Name: "backend", Check: func(ctx context.Context) error {
+			return be.err
+		}})
+	} else {
+		checks = append(checks,
+			handlers.IronCheck(be.client, readinessCheckInterval),
+			handlers.CrontabCheck(be.crontab),
+		)
+		if be.config.Type == config.BackendFerrite {
+			checks = append(checks, handlers.BootstrapCheck(be.ironConfig))
+		}
+	}
+	if multiple {
+		for i := range checks {
+			checks[i].Name += ":" + be.name
+			checks[i].Optional = true
+		}
+	}
+	return checks
+}
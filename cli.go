@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/config"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	"github.com/philips-labs/hsdp-funcion-gateway/handlers"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/ratelimit"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// upstreamHost is where sync workers accept requests through the tunnel
+const upstreamHost = "localhost:8081"
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [-config file] [-backend name] <command> [arguments]
+
+Commands:
+  serve                              run the gateway (default)
+  validate-config                    check the configuration and the connectivity to Iron and IAM
+  functions list                     list the functions with their schedules
+  invoke <code> [flags]              invoke a function through the gateway logic, for debugging
+  cron list                          list the cron schedules with their next run
+  cron next <expr> [flags]           print the next runs of a cron expression
+  token hash [token]                 hash a token for the token store, read from stdin when omitted
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// validateConfig loads the configuration and checks every dependency it refers to
+func validateConfig(configFile string) int {
+	cfg, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitInvalidConfig
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "FAIL\t%s\t%v\n", name, err)
+			return
+		}
+		fmt.Fprintf(w, "ok\t%s\t\n", name)
+	}
+	check("configuration", nil)
+
+	backends := cfg.BackendConfigs()
+	for _, name := range cfg.BackendNames() {
+		client, _, err := newIronClient(backends[name])
+		if err == nil {
+			_, err = listCodes(client)
+		}
+		check("backend "+name+" ("+backends[name].Type+")", err)
+	}
+
+	auth, err := newAuthChain(cfg.Auth)
+	if err == nil {
+		auth.Close()
+	}
+	check("auth", err)
+	if cfg.Auth.HasType(config.AuthIAM) {
+		check("iam", mw.CheckIAM(cfg.Auth.IAM))
+	}
+	_, err = cfg.PolicyStore()
+	check("policies", err)
+	_, err = ratelimit.New(cfg.RateLimits)
+	check("rate limits", err)
+	if cfg.TLS.Addr != "" {
+		_, err = newTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		check("tls", err)
+	}
+	_ = w.Flush()
+	if failed {
+		return exitFailure
+	}
+	return 0
+}
+
+// functions implements "functions list"
+func functions(configFile, backendName string, args []string) int {
+	if len(args) != 1 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "usage: functions list")
+		return exitUsage
+	}
+	_, be, code := cliBackend(configFile, backendName)
+	if be == nil {
+		return code
+	}
+	client := be.client
+	codes, err := listCodes(client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tIMAGE\tREV\tSCHEDULES")
+	for _, c := range codes {
+		var types []string
+		schedules, _, err := client.Schedules.GetSchedulesWithCode(c.Name)
+		if err != nil {
+			types = append(types, "error: "+err.Error())
+		} else {
+			for _, s := range *schedules {
+				if t := handlers.DecodeSchedule(s).Type; t != "" {
+					types = append(types, t)
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", c.ID, c.Name, c.Image, c.Rev, strings.Join(types, ","))
+	}
+	_ = w.Flush()
+	return 0
+}
+
+// invoke runs a function through the same round tripper as the gateway routes
+func invoke(configFile, backendName string, args []string) int {
+	fs := flag.NewFlagSet("invoke", flag.ContinueOnError)
+	async := fs.Bool("async", false, "queue an async task instead of a sync request")
+	data := fs.String("data", "", "request body, @file reads a file and @- reads stdin")
+	path := fs.String("path", "/", "path of the request to the function")
+	method := fs.String("method", http.MethodPost, "method of a sync request")
+	callback := fs.String("callback", "", "callback URL of an async invocation")
+	wait := fs.Duration("wait", 5*time.Minute, "how long an async invocation serves its payload")
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: invoke <code ID or name> [flags]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	body, err := readData(*data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	cfg, be, code := cliBackend(configFile, backendName)
+	if be == nil {
+		return code
+	}
+	client := be.client
+	codeID, err := resolveCode(client, positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	transport := handlers.NewIronBackendRoundTripper(http.DefaultTransport, client, upstreamHost)
+	transport.Clusters = clusters.NewSelector(client, be.ironConfig.ClusterInfo, be.config.Clusters)
+	if *async {
+		return invokeAsync(cfg, transport, handlers.AsyncRequest{
+			CodeID:      codeID,
+			Path:        strings.TrimPrefix(*path, "/"),
+			CallbackURL: *callback,
+			Body:        body,
+		}, *wait)
+	}
+
+	target := "/function/" + codeID + "/" + strings.TrimPrefix(*path, "/")
+	req := httptest.NewRequest(*method, target, strings.NewReader(string(body)))
+	req.URL.Scheme = "http"
+	req.URL.Host = upstreamHost
+	req.Host = upstreamHost
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer resp.Body.Close()
+	fmt.Fprintln(os.Stderr, resp.Status)
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return 0
+}
+
+// invokeAsync queues an async task and serves its payload on the gateway listener until
+// the task collected it, as the payload only lives in the memory of this process
+func invokeAsync(cfg *config.Config, transport *handlers.IronBackendRoundTripper, r handlers.AsyncRequest, wait time.Duration) int {
+	if r.CallbackURL == "" {
+		fmt.Fprintln(os.Stderr, "async invocations require -callback")
+		return exitUsage
+	}
+	auth, err := newAuthChain(cfg.Auth)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	defer auth.Close()
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Group("/payload", auth.Tokens(mw.ScopePayloadRead)).GET("/:taskID", handlers.Payload(transport))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(cfg.Listen)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	taskID, err := transport.QueueAsync(ctx, r, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		_ = e.Close()
+		return exitFailure
+	}
+	fmt.Println(taskID)
+
+	exitCode := 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for pending := true; pending; {
+		select {
+		case <-ticker.C:
+			pending = len(transport.OwnedTasks()) > 0
+		case <-ctx.Done():
+			fmt.Fprintln(os.Stderr, "task did not collect its payload, cancelling it")
+			exitCode, pending = exitFailure, false
+		case err := <-serverErr:
+			if !errors.Is(err, http.ErrServerClosed) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			exitCode, pending = exitFailure, false
+		}
+	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.DefaultShutdownTimeout)
+	defer cancelShutdown()
+	_ = e.Shutdown(shutdownCtx)
+	if err := transport.Shutdown(shutdownCtx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return exitCode
+}
+
+// cronCommand implements "cron list" and "cron next"
+func cronCommand(configFile, backendName string, args []string) int {
+	if len(args) > 0 && args[0] == "next" {
+		return cronNext(args[1:])
+	}
+	if len(args) != 1 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "usage: cron list | cron next <expr> [flags]")
+		return exitUsage
+	}
+	cfg, be, code := cliBackend(configFile, backendName)
+	if be == nil {
+		return code
+	}
+	client := be.client
+	schedules, resp, err := client.Schedules.GetSchedules()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("listing schedules: %s", resp.Status)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	sort.Slice(*schedules, func(i, j int) bool {
+		return (*schedules)[i].CodeName < (*schedules)[j].CodeName
+	})
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCHEDULE\tCODE\tEXPRESSION\tEFFECTIVE\tNEXT")
+	for _, s := range *schedules {
+		info := handlers.DecodeSchedule(s)
+		if info.Type != handlers.ScheduleCron {
+			continue
+		}
+		next := "-"
+		effective, times, err := cfg.Cron.Next(info.Expression, s.ID, now, 1)
+		if err != nil {
+			next = "invalid: " + err.Error()
+		} else if len(times) > 0 {
+			next = times[0].Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.CodeName, info.Expression, effective, next)
+	}
+	_ = w.Flush()
+	return 0
+}
+
+// cronNext prints the next trigger times of an expression, as the crontab would schedule them
+func cronNext(args []string) int {
+	fs := flag.NewFlagSet("cron next", flag.ContinueOnError)
+	seconds := fs.Bool("seconds", false, "accept a leading seconds field")
+	key := fs.String("key", "", "schedule ID used to expand H tokens")
+	count := fs.Int("count", 5, "number of trigger times")
+	positional, err := parseArgs(fs, args)
+	if err != nil || len(positional) != 1 || *count < 1 {
+		fmt.Fprintln(os.Stderr, "usage: cron next <expr> [flags]")
+		fs.PrintDefaults()
+		return exitUsage
+	}
+	effective, times, err := crontab.Config{Seconds: *seconds}.Next(positional[0], *key, time.Now(), *count)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	if effective != positional[0] {
+		fmt.Printf("# %s\n", effective)
+	}
+	for _, t := range times {
+		fmt.Println(t.Format(time.RFC3339))
+	}
+	return 0
+}
+
+// token implements "token hash"
+func token(args []string) int {
+	if len(args) < 1 || len(args) > 2 || args[0] != "hash" {
+		fmt.Fprintln(os.Stderr, "usage: token hash [token]")
+		return exitUsage
+	}
+	var plain string
+	if len(args) == 2 {
+		plain = args[1]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+		plain = strings.TrimRight(line, "\r\n")
+	}
+	if plain == "" {
+		fmt.Fprintln(os.Stderr, "empty token")
+		return exitUsage
+	}
+	hash, err := mw.HashToken(plain)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+// cliBackend loads the configuration and returns a backend with its Iron client, the default
+// backend when name is empty. The backend is nil on errors, with the exit code
+func cliBackend(configFile, name string) (*config.Config, *backend, int) {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, exitInvalidConfig
+	}
+	b, ok := cfg.BackendConfigs()[name]
+	if name == "" {
+		name, b = cfg.DefaultBackendConfig()
+		ok = name != ""
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown backend %q, configured are %s\n", name, strings.Join(cfg.BackendNames(), ", "))
+		return nil, nil, exitUsage
+	}
+	be := &backend{name: name, config: b}
+	be.client, be.ironConfig, err = newIronClient(b)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, exitFailure
+	}
+	return cfg, be, 0
+}
+
+func listCodes(client *iron.Client) ([]iron.Code, error) {
+	codes, resp, err := client.Codes.GetCodes()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing codes: %s", resp.Status)
+	}
+	sort.Slice(*codes, func(i, j int) bool {
+		return (*codes)[i].Name < (*codes)[j].Name
+	})
+	return *codes, nil
+}
+
+// resolveCode returns the ID of the code with ID or name ref
+func resolveCode(client *iron.Client, ref string) (string, error) {
+	codes, err := listCodes(client)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range codes {
+		if c.ID == ref || c.Name == ref {
+			return c.ID, nil
+		}
+	}
+	return "", fmt.Errorf("code %q not found", ref)
+}
+
+// parseArgs parses flags before and after the positional arguments, which it returns
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// readData returns the body given by -data: literal text, @file or @- for stdin
+func readData(data string) ([]byte, error) {
+	switch {
+	case data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(data[1:])
+	}
+	return []byte(data), nil
+}
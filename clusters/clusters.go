@@ -0,0 +1,320 @@
+package clusters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// Strategies select the cluster of a task
+const (
+	// StrategySchedule queues on the cluster named by the schedule
+	StrategySchedule = "schedule"
+	// StrategyPinned queues on the configured cluster
+	StrategyPinned = "pinned"
+	// StrategyRoundRobin rotates over the clusters which can run the function
+	StrategyRoundRobin = "round-robin"
+	// StrategyLeastLoaded picks the cluster with the fewest queued tasks
+	StrategyLeastLoaded = "least-loaded"
+)
+
+const defaultStatsInterval = 10 * time.Second
+
+// Selection is the cluster selection policy of a function
+type Selection struct {
+	// Strategy is schedule, pinned, round-robin or least-loaded. Defaults to schedule
+	Strategy string `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	// Cluster is the cluster ID of the pinned strategy
+	Cluster string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	// Failover tries the other clusters when queueing a task on the selected cluster fails
+	Failover bool `json:"failover,omitempty" yaml:"failover,omitempty"`
+}
+
+// Validate checks the strategy and its settings
+func (s Selection) Validate() error {
+	switch s.Strategy {
+	case "", StrategySchedule, StrategyRoundRobin, StrategyLeastLoaded:
+		if s.Cluster != "" {
+			return fmt.Errorf("cluster is only used by the %q strategy", StrategyPinned)
+		}
+	case StrategyPinned:
+		if s.Cluster == "" {
+			return fmt.Errorf("strategy %q requires a cluster", StrategyPinned)
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", s.Strategy)
+	}
+	return nil
+}
+
+// Config configures cluster selection
+type Config struct {
+	Default Selection `json:"default" yaml:"default"`
+	// Functions override the default selection, keyed by code name
+	Functions map[string]Selection `json:"functions,omitempty" yaml:"functions,omitempty"`
+	// StatsInterval is how long the queued task counts of clusters are cached. Defaults to 10s
+	StatsInterval time.Duration `json:"stats_interval,omitempty" yaml:"stats_interval,omitempty"`
+}
+
+// SelectionFor returns the selection of a function
+func (c Config) SelectionFor(codeName string) Selection {
+	if selection, ok := c.Functions[codeName]; ok {
+		return selection
+	}
+	return c.Default
+}
+
+// scheduleOptions are gateway specific settings in a schedule payload. The encrypted
+// payload of a schedule can only be decrypted by clusters sharing the key it was
+// encrypted with, EncryptedPayloads holds payloads for other clusters keyed by cluster ID
+type scheduleOptions struct {
+	EncryptedPayloads map[string]string `json:"encrypted_payloads,omitempty"`
+}
+
+// Candidate is a cluster a task can be queued on with the payload encrypted for it
+type Candidate struct {
+	Cluster string
+	Payload string
+}
+
+// QueueFunc queues a task, typically Tasks.QueueTask wrapped in instrumentation
+type QueueFunc func(task iron.Task) (*iron.Task, *iron.Response, error)
+
+// Selector chooses the clusters tasks are queued on
+type Selector struct {
+	client   *iron.Client
+	config   Config
+	clusters []iron.ClusterInfo
+	queued   *cache.Cache
+
+	mu     sync.Mutex
+	next   map[string]int
+	served map[string]int
+}
+
+// NewSelector returns a selector over clusters, the cluster info of the Iron configuration
+func NewSelector(client *iron.Client, clusters []iron.ClusterInfo, config Config) *Selector {
+	interval := config.StatsInterval
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+	return &Selector{
+		client:   client,
+		config:   config,
+		clusters: clusters,
+		queued:   cache.New(interval, 2*interval),
+		next:     make(map[string]int),
+		served:   make(map[string]int),
+	}
+}
+
+// Served returns the number of tasks queued per cluster since the start
+func (s *Selector) Served() map[string]int {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	served := make(map[string]int, len(s.served))
+	for cluster, n := range s.served {
+		served[cluster] = n
+	}
+	return served
+}
+
+// Candidates returns the clusters a task of schedule can be queued on, in order of preference.
+// Without failover only the selected cluster is returned
+func (s *Selector) Candidates(schedule iron.Schedule, encryptedPayload string) ([]Candidate, error) {
+	primary := Candidate{Cluster: schedule.Cluster, Payload: encryptedPayload}
+	if s == nil {
+		return []Candidate{primary}, nil
+	}
+	selection := s.config.SelectionFor(schedule.CodeName)
+	if (selection.Strategy == "" || selection.Strategy == StrategySchedule) && !selection.Failover {
+		return []Candidate{primary}, nil
+	}
+	var options scheduleOptions
+	_ = json.Unmarshal([]byte(schedule.Payload), &options)
+
+	var pool []Candidate
+	for _, cluster := range s.pool(schedule.Cluster) {
+		if payload, ok := s.payloadFor(cluster, schedule, options, encryptedPayload); ok {
+			pool = append(pool, Candidate{Cluster: cluster, Payload: payload})
+		}
+	}
+	first := -1
+	switch selection.Strategy {
+	case StrategyPinned:
+		first = indexOf(pool, selection.Cluster)
+		if first < 0 {
+			return nil, fmt.Errorf("no payload for pinned cluster %s of %s", selection.Cluster, schedule.CodeName)
+		}
+	case StrategyRoundRobin:
+		if len(pool) > 0 {
+			s.mu.Lock()
+			first = s.next[schedule.CodeName] % len(pool)
+			s.next[schedule.CodeName] = first + 1
+			s.mu.Unlock()
+		}
+	case StrategyLeastLoaded:
+		loads := make(map[string]int, len(pool))
+		for _, c := range pool {
+			loads[c.Cluster] = s.load(c.Cluster)
+		}
+		sort.SliceStable(pool, func(i, j int) bool {
+			return loads[pool[i].Cluster] < loads[pool[j].Cluster]
+		})
+		first = 0
+	default:
+		// The cluster of the schedule, which may be the default cluster of the project
+		if first = indexOf(pool, schedule.Cluster); first < 0 {
+			pool = append([]Candidate{primary}, pool...)
+			first = 0
+		}
+	}
+	if first < 0 || first >= len(pool) {
+		return nil, fmt.Errorf("no cluster can run %s", schedule.CodeName)
+	}
+	candidates := []Candidate{pool[first]}
+	if selection.Failover {
+		for i := 1; i < len(pool); i++ {
+			candidates = append(candidates, pool[(first+i)%len(pool)])
+		}
+	}
+	return candidates, nil
+}
+
+// Queue queues task on the first candidate cluster of schedule which accepts it.
+// The returned task names the cluster serving it. A nil Selector queues on the
+// cluster of the schedule
+func (s *Selector) Queue(schedule iron.Schedule, encryptedPayload string, task iron.Task, queue QueueFunc) (*iron.Task, error) {
+	candidates, err := s.Candidates(schedule, encryptedPayload)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for i, candidate := range candidates {
+		task.Cluster = candidate.Cluster
+		task.Payload = candidate.Payload
+		queued, err := queueOn(task, queue)
+		if err == nil {
+			if queued.Cluster == "" {
+				queued.Cluster = candidate.Cluster
+			}
+			if s != nil {
+				s.mu.Lock()
+				s.served[queued.Cluster]++
+				s.mu.Unlock()
+			}
+			return queued, nil
+		}
+		errs = append(errs, fmt.Errorf("cluster %s: %w", candidate.Cluster, err))
+		if i < len(candidates)-1 {
+			metrics.ClusterFailovers.WithLabelValues(candidate.Cluster).Inc()
+			slog.Warn("queueing task failed, trying next cluster", "code_name", schedule.CodeName,
+				"cluster", candidate.Cluster, "next_cluster", candidates[i+1].Cluster, "error", err)
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
+
+func queueOn(task iron.Task, queue QueueFunc) (*iron.Task, error) {
+	queued, resp, err := queue(task)
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil && resp.Response != nil && resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("queueing task: %s", resp.Status)
+	}
+	if queued == nil || queued.ID == "" {
+		return nil, errors.New("queueing task: no task returned")
+	}
+	return queued, nil
+}
+
+// pool returns the configured cluster IDs and the cluster of the schedule
+func (s *Selector) pool(scheduleCluster string) []string {
+	pool := make([]string, 0, len(s.clusters)+1)
+	for _, info := range s.clusters {
+		if info.ClusterID != "" && !contains(pool, info.ClusterID) {
+			pool = append(pool, info.ClusterID)
+		}
+	}
+	if scheduleCluster != "" && !contains(pool, scheduleCluster) {
+		pool = append(pool, scheduleCluster)
+	}
+	return pool
+}
+
+// payloadFor returns the payload of schedule decryptable by cluster
+func (s *Selector) payloadFor(cluster string, schedule iron.Schedule, options scheduleOptions, encryptedPayload string) (string, bool) {
+	if payload, ok := options.EncryptedPayloads[cluster]; ok {
+		return payload, true
+	}
+	if cluster == schedule.Cluster {
+		return encryptedPayload, true
+	}
+	key := s.pubkey(cluster)
+	return encryptedPayload, key != "" && key == s.pubkey(schedule.Cluster)
+}
+
+func (s *Selector) pubkey(cluster string) string {
+	for _, info := range s.clusters {
+		if info.ClusterID == cluster || (info.ClusterName != "" && info.ClusterName == cluster) {
+			return info.Pubkey
+		}
+	}
+	return ""
+}
+
+// load returns the queued task count of a cluster. Clusters without stats sort last
+func (s *Selector) load(cluster string) int {
+	if cached, ok := s.queued.Get(cluster); ok {
+		return cached.(int)
+	}
+	start := time.Now()
+	stats, resp, err := s.client.Clusters.GetClusterStats(cluster)
+	if err == nil && resp != nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("cluster stats: %s", resp.Status)
+	}
+	metrics.ObserveIron("get_cluster_stats", start, err)
+	queued := math.MaxInt
+	if err != nil {
+		slog.Warn("error retrieving cluster stats", "cluster", cluster, "error", err)
+	} else {
+		queued = stats.Queued
+	}
+	s.queued.Set(cluster, queued, cache.DefaultExpiration)
+	return queued
+}
+
+func indexOf(candidates []Candidate, cluster string) int {
+	for i, c := range candidates {
+		if c.Cluster == cluster {
+			return i
+		}
+	}
+	return -1
+}
+
+func contains(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
+	}
+	return false
+}
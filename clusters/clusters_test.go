@@ -0,0 +1,125 @@
+package clusters
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/philips-software/go-hsdp-api/iron"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var clusterInfo = []iron.ClusterInfo{
+	{ClusterID: "c1", Pubkey: "key-a"},
+	{ClusterID: "c2", Pubkey: "key-a"},
+	{ClusterID: "c3", Pubkey: "key-b"},
+}
+
+func newClient(t *testing.T, queued map[string]int) *iron.Client {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	client, err := iron.NewClient(&iron.Config{BaseURL: server.URL, ProjectID: "project", Token: "token"})
+	assert.NoError(t, err)
+	for id, n := range queued {
+		n := n
+		mux.HandleFunc(client.Path("clusters", id, "stats"), func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{"cluster":{"queued":`+strconv.Itoa(n)+`}}`)
+		})
+	}
+	return client
+}
+
+func clusterIDs(candidates []Candidate) []string {
+	ids := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.Cluster)
+	}
+	return ids
+}
+
+func TestCandidates(t *testing.T) {
+	schedule := iron.Schedule{CodeName: "fn", Cluster: "c1", Payload: `{"encrypted_payloads":{"c3":"payload-c3"}}`}
+
+	var nilSelector *Selector
+	candidates, err := nilSelector.Candidates(schedule, "payload")
+	assert.NoError(t, err)
+	assert.Equal(t, []Candidate{{Cluster: "c1", Payload: "payload"}}, candidates)
+
+	s := NewSelector(newClient(t, nil), clusterInfo, Config{
+		Functions: map[string]Selection{"fn": {Strategy: StrategyRoundRobin}},
+	})
+	var picked []string
+	for i := 0; i < 4; i++ {
+		candidates, err := s.Candidates(schedule, "payload")
+		assert.NoError(t, err)
+		if assert.Len(t, candidates, 1) {
+			picked = append(picked, candidates[0].Cluster)
+		}
+	}
+	assert.Equal(t, []string{"c1", "c2", "c3", "c1"}, picked)
+
+	s = NewSelector(newClient(t, nil), clusterInfo, Config{
+		Default: Selection{Strategy: StrategyPinned, Cluster: "c3", Failover: true},
+	})
+	candidates, err = s.Candidates(schedule, "payload")
+	assert.NoError(t, err)
+	assert.Equal(t, []Candidate{
+		{Cluster: "c3", Payload: "payload-c3"},
+		{Cluster: "c1", Payload: "payload"},
+		{Cluster: "c2", Payload: "payload"},
+	}, candidates)
+
+	// c3 uses another key and has no payload of its own
+	schedule.Payload = `{}`
+	_, err = s.Candidates(schedule, "payload")
+	assert.Error(t, err)
+}
+
+func TestCandidatesLeastLoaded(t *testing.T) {
+	s := NewSelector(newClient(t, map[string]int{"c1": 5, "c2": 1}), clusterInfo, Config{
+		Default: Selection{Strategy: StrategyLeastLoaded, Failover: true},
+	})
+	candidates, err := s.Candidates(iron.Schedule{CodeName: "fn", Cluster: "c1"}, "payload")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c2", "c1"}, clusterIDs(candidates))
+}
+
+func TestQueueFailover(t *testing.T) {
+	s := NewSelector(newClient(t, nil), clusterInfo, Config{
+		Default: Selection{Failover: true},
+	})
+	before := testutil.ToFloat64(metrics.ClusterFailovers.WithLabelValues("c1"))
+	var attempts []string
+	task, err := s.Queue(iron.Schedule{CodeName: "fn", Cluster: "c1"}, "payload", iron.Task{CodeName: "fn"},
+		func(task iron.Task) (*iron.Task, *iron.Response, error) {
+			attempts = append(attempts, task.Cluster)
+			if task.Cluster == "c1" {
+				return nil, nil, errors.New("cluster unavailable")
+			}
+			return &iron.Task{ID: "task1"}, nil, nil
+		})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "task1", task.ID)
+		assert.Equal(t, "c2", task.Cluster)
+	}
+	assert.Equal(t, []string{"c1", "c2"}, attempts)
+	assert.Equal(t, before+1, testutil.ToFloat64(metrics.ClusterFailovers.WithLabelValues("c1")))
+	assert.Equal(t, map[string]int{"c2": 1}, s.Served())
+
+	// Without failover the error of the selected cluster is returned
+	s = NewSelector(newClient(t, nil), clusterInfo, Config{})
+	_, err = s.Queue(iron.Schedule{CodeName: "fn", Cluster: "c1"}, "payload", iron.Task{},
+		func(task iron.Task) (*iron.Task, *iron.Response, error) {
+			return nil, &iron.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}}, nil
+		})
+	if assert.Error(t, err) {
+		assert.Equal(t, "queueing task: 503 Service Unavailable", err.Error())
+	}
+}
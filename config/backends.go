@@ -0,0 +1,125 @@
+package config
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+)
+
+// DefaultBackendName is the name of the backend configured by iron and backend
+const DefaultBackendName = "default"
+
+// backendName restricts backend names to a single lower case path segment
+var backendName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// BackendConfig is a named Iron project or ferrite server. Each backend has its own
+// client, crontab and cluster selection
+type BackendConfig struct {
+	// Type is "iron" or "ferrite", which is bootstrapped on start. Defaults to "iron"
+	Type     string          `json:"type" yaml:"type"`
+	Iron     IronConfig      `json:"iron" yaml:"iron"`
+	Clusters clusters.Config `json:"clusters" yaml:"clusters"`
+}
+
+// hasDefaultBackend reports whether iron configures a backend, which it must when there are no Backends
+func (c *Config) hasDefaultBackend() bool {
+	return len(c.Backends) == 0 || c.Iron.Token != "" || c.Iron.ProjectID != "" || c.Iron.BaseURL != ""
+}
+
+// BackendConfigs returns the configured backends by name, including the default backend
+func (c *Config) BackendConfigs() map[string]BackendConfig {
+	backends := make(map[string]BackendConfig, len(c.Backends)+1)
+	for name, backend := range c.Backends {
+		if backend.Type == "" {
+			backend.Type = BackendIron
+		}
+		backends[name] = backend
+	}
+	if c.hasDefaultBackend() {
+		backends[DefaultBackendName] = BackendConfig{Type: c.Backend, Iron: c.Iron, Clusters: c.Clusters}
+	}
+	return backends
+}
+
+// BackendNames returns the sorted names of the configured backends
+func (c *Config) BackendNames() []string {
+	backends := c.BackendConfigs()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultBackendConfig returns the name of the backend serving the routes without a backend name.
+// It is empty when there is no such backend
+func (c *Config) DefaultBackendConfig() (string, BackendConfig) {
+	name := c.DefaultBackend
+	if name == "" {
+		name = DefaultBackendName
+	}
+	backend, ok := c.BackendConfigs()[name]
+	if !ok {
+		return "", BackendConfig{}
+	}
+	return name, backend
+}
+
+func (c *Config) validateBackends(p *problems) {
+	if c.hasDefaultBackend() {
+		c.validateBackend("", BackendConfig{Type: c.Backend, Iron: c.Iron, Clusters: c.Clusters}, p)
+	}
+	names := make([]string, 0, len(c.Backends))
+	for name := range c.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prefix := "backends." + name + "."
+		if !backendName.MatchString(name) {
+			p.add("backends: invalid name %q, use lower case letters, digits, - and _", name)
+		}
+		if name == DefaultBackendName && c.hasDefaultBackend() {
+			p.add("backends: %q is configured by iron and backend", DefaultBackendName)
+		}
+		backend := c.Backends[name]
+		if backend.Type == "" {
+			backend.Type = BackendIron
+		}
+		c.validateBackend(prefix, backend, p)
+	}
+	if c.DefaultBackend != "" {
+		if _, ok := c.BackendConfigs()[c.DefaultBackend]; !ok {
+			p.add("default_backend %q is not configured", c.DefaultBackend)
+		}
+	}
+}
+
+// validateBackend validates a backend, prefix is empty for the default backend whose settings are top level
+func (c *Config) validateBackend(prefix string, b BackendConfig, p *problems) {
+	typeKey := "backend"
+	if prefix != "" {
+		typeKey = prefix + "type"
+	}
+	switch b.Type {
+	case BackendIron:
+		if b.Iron.ProjectID == "" {
+			p.add("%siron.project_id is required", prefix)
+		}
+	case BackendFerrite:
+		if b.Iron.BaseURL == "" {
+			p.add("%siron.base_url is required for the ferrite backend", prefix)
+		}
+	default:
+		p.add("%s must be %q or %q, got %q", typeKey, BackendIron, BackendFerrite, b.Type)
+	}
+	if b.Iron.Token == "" {
+		p.add("%siron.token is required", prefix)
+	}
+	if len(b.Iron.ClusterInfo) == 0 {
+		p.add("%siron.cluster_info requires at least one cluster", prefix)
+	}
+	validateClusters(prefix, b, p)
+}
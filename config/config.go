@@ -0,0 +1,239 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-labs/hsdp-funcion-gateway/ratelimit"
+	"github.com/philips-labs/hsdp-funcion-gateway/tracing"
+	"github.com/philips-software/go-hsdp-api/iron"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults
+const (
+	DefaultListen          = ":8079"
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// Backend types
+const (
+	BackendIron    = "iron"
+	BackendFerrite = "ferrite"
+)
+
+// Auth types
+const (
+	AuthNone   = "none"
+	AuthToken  = "token"
+	AuthIAM    = "iam"
+	AuthJWT    = "jwt"
+	AuthSigned = "signed"
+	AuthCert   = "cert"
+)
+
+// Auth modes
+const (
+	AuthModeAny = "any"
+	AuthModeAll = "all"
+)
+
+// Config is the gateway configuration. It is loaded from a YAML or JSON file, after
+// which environment variables override individual settings. Auth, Policies and
+// RateLimits are reloaded on SIGHUP or when the file changes, the rest needs a restart
+type Config struct {
+	Iron IronConfig `yaml:"iron"`
+	// Backend is "iron" or "ferrite", which is bootstrapped on start
+	Backend string `yaml:"backend"`
+	Listen  string `yaml:"listen"`
+	// TunnelAddr is the address of the tunnel server workers connect through, checked by /readyz. Optional
+	TunnelAddr string     `yaml:"tunnel_addr"`
+	TLS        TLSConfig  `yaml:"tls"`
+	Auth       AuthConfig `yaml:"auth"`
+	PolicyFile string     `yaml:"policy_file"`
+	// Policies are keyed by code ID or code name and take precedence over PolicyFile
+	Policies        map[string]policy.Policy `yaml:"policies"`
+	RateLimits      ratelimit.Config         `yaml:"rate_limits"`
+	Cron            crontab.Config           `yaml:"cron"`
+	AuditLog        string                   `yaml:"audit_log"`
+	Logging         logging.Config           `yaml:"logging"`
+	Tracing         tracing.Config           `yaml:"tracing"`
+	ShutdownTimeout time.Duration            `yaml:"shutdown_timeout"`
+	// Clusters selects the Iron cluster of each task when iron.cluster_info lists several clusters
+	Clusters clusters.Config `yaml:"clusters"`
+	// Backends are additional Iron projects or ferrite servers, keyed by name. Iron and Backend
+	// configure the backend named "default", which may be omitted when Backends is set
+	Backends map[string]BackendConfig `yaml:"backends"`
+	// DefaultBackend serves the routes without a backend name. Defaults to "default"
+	DefaultBackend string `yaml:"default_backend"`
+	// TrustedProxies are the IPs or CIDRs of proxies whose X-Forwarded-For header identifies
+	// the client, e.g. for the rate limits of public functions. Empty uses the peer address
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// TrustedNetworks returns the networks of TrustedProxies. An IP is a network of one address
+func (c *Config) TrustedNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// IronConfig is the Iron service configuration, using the keys of the IRON_CONFIG service binding
+type IronConfig struct {
+	iron.Config
+}
+
+// UnmarshalYAML decodes the Iron configuration using its JSON field names
+func (c *IronConfig) UnmarshalYAML(node *yaml.Node) error {
+	var raw interface{}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(&c.Config)
+}
+
+// TLSConfig enables an additional TLS listener
+type TLSConfig struct {
+	Addr     string `yaml:"addr"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile enables verification of client certificates, required for cert auth
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig configures the authenticators of the function routes
+type AuthConfig struct {
+	// Types are tried in order. Defaults to token
+	Types []string `yaml:"types"`
+	// Mode is "any", the first successful authenticator wins, or "all"
+	Mode     string          `yaml:"mode"`
+	Token    TokenConfig     `yaml:"token"`
+	IAM      mw.IAMConfig    `yaml:"iam"`
+	IAMCache IAMCacheConfig  `yaml:"iam_cache"`
+	JWT      mw.JWTConfig    `yaml:"jwt"`
+	Signed   mw.SignedConfig `yaml:"signed"`
+	Cert     mw.CertConfig   `yaml:"cert"`
+}
+
+// HasType reports whether authType is configured
+func (c AuthConfig) HasType(authType string) bool {
+	for _, t := range c.Types {
+		if t == authType {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenConfig configures the token store. The legacy Token, which is shared with chisel,
+// is granted all scopes. StoreFile is watched for changes
+type TokenConfig struct {
+	Token     string           `yaml:"token"`
+	StoreFile string           `yaml:"store_file"`
+	Tokens    []mw.StoredToken `yaml:"tokens"`
+}
+
+// IAMCacheConfig configures the IAM introspection cache
+type IAMCacheConfig struct {
+	Size        int           `yaml:"size"`
+	TTL         time.Duration `yaml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+// Default returns the configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		Backend:         BackendIron,
+		Listen:          DefaultListen,
+		ShutdownTimeout: DefaultShutdownTimeout,
+	}
+}
+
+// Load reads the configuration file at path, which may be empty, applies the
+// environment overrides and validates the result
+func Load(path string) (*Config, error) {
+	config := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := config.decode(f); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if len(config.Auth.Types) == 0 {
+		config.Auth.Types = []string{AuthToken}
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decode strictly decodes YAML, or JSON which is a subset of it. Unknown fields are errors
+func (c *Config) decode(r io.Reader) error {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// PolicyStore returns the policies of PolicyFile merged with the inline policies,
+// which take precedence
+func (c *Config) PolicyStore() (*policy.Store, error) {
+	store := &policy.Store{Policies: make(map[string]policy.Policy)}
+	if c.PolicyFile != "" {
+		fileStore, err := policy.LoadFile(c.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, p := range fileStore.Policies {
+			store.Policies[key] = p
+		}
+	}
+	for key, p := range c.Policies {
+		if p.Name == "" {
+			p.Name = key
+		}
+		store.Policies[key] = p
+	}
+	return store, nil
+}
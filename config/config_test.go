@@ -0,0 +1,270 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+const validYAML = `
+iron:
+  project_id: project
+  token: iron-token
+  cluster_info:
+    - cluster_id: cluster
+      pubkey: key
+listen: ":9000"
+auth:
+  types: [iam, token]
+  token:
+    token: secret
+  iam:
+    client_id: client
+    client_secret: secret
+    region: us-east
+    organizations: [org1]
+    include_child_organizations: true
+    permissions:
+      all_of: [FUNCTION.INVOKE]
+  iam_cache:
+    ttl: 5m
+policies:
+  reports:
+    roles: [ADMIN]
+rate_limits:
+  default:
+    rate: 10
+    burst: 20
+  principals:
+    "token:batch":
+      daily_quota: 1000
+cron:
+  seconds: true
+  jitter: 30s
+shutdown_timeout: 1m
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	config, err := Load(writeFile(t, "gateway.yaml", validYAML))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "project", config.Iron.ProjectID)
+	assert.Equal(t, "cluster", config.Iron.ClusterInfo[0].ClusterID)
+	assert.Equal(t, BackendIron, config.Backend)
+	assert.Equal(t, ":9000", config.Listen)
+	assert.Equal(t, []string{AuthIAM, AuthToken}, config.Auth.Types)
+	assert.Equal(t, []string{"FUNCTION.INVOKE"}, config.Auth.IAM.Permissions.AllOf)
+	assert.True(t, config.Auth.IAM.IncludeChildOrganizations)
+	assert.Equal(t, 5*time.Minute, config.Auth.IAMCache.TTL)
+	assert.Equal(t, 1000, config.RateLimits.Principals["token:batch"].DailyQuota)
+	assert.True(t, config.Cron.Seconds)
+	assert.Equal(t, 30*time.Second, config.Cron.Jitter)
+	assert.Equal(t, time.Minute, config.ShutdownTimeout)
+
+	store, err := config.PolicyStore()
+	if assert.NoError(t, err) {
+		p, ok := store.Lookup("reports")
+		if assert.True(t, ok) {
+			assert.Equal(t, "reports", p.Name)
+		}
+	}
+}
+
+func TestLoadJSONWithEnvOverrides(t *testing.T) {
+	path := writeFile(t, "gateway.json", `{"iron": {"project_id": "project", "token": "t", "cluster_info": [{"cluster_id": "c"}]}}`)
+	t.Setenv("GATEWAY_AUTH_TYPE", "token,jwt")
+	t.Setenv("AUTH_TOKEN_TOKEN", "secret")
+	t.Setenv("AUTH_JWT_JWKS_URL", "https://iam.example.com/jwks")
+	t.Setenv("AUTH_JWT_LEEWAY", "10s")
+	t.Setenv("CRON_SECONDS", "true")
+
+	config, err := Load(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{AuthToken, AuthJWT}, config.Auth.Types)
+	assert.Equal(t, "secret", config.Auth.Token.Token)
+	assert.Equal(t, 10*time.Second, config.Auth.JWT.Leeway)
+	assert.True(t, config.Cron.Seconds)
+
+	t.Setenv("AUTH_JWT_LEEWAY", "soon")
+	_, err = Load(path)
+	assert.EqualError(t, err, `invalid AUTH_JWT_LEEWAY: time: invalid duration "soon"`)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	_, err := Load(writeFile(t, "unknown.yaml", "iron:\n  project_id: p\nauth_type: iam\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "field auth_type not found")
+	}
+
+	_, err = Load(writeFile(t, "invalid.yaml", `
+backend: lambda
+auth:
+  types: [tokens, iam, cert]
+  mode: some
+rate_limits:
+  default:
+    rate: -1
+`))
+	var validationErr *ValidationError
+	if assert.True(t, errors.As(err, &validationErr)) {
+		assert.Equal(t, []string{
+			`backend must be "iron" or "ferrite", got "lambda"`,
+			"iron.token is required",
+			"iron.cluster_info requires at least one cluster",
+			`auth.mode must be "any" or "all", got "some"`,
+			`unknown auth type "tokens"`,
+			"iam auth requires auth.iam.client_id and auth.iam.client_secret",
+			"iam auth requires auth.iam.region or auth.iam.iam_url",
+			"cert auth requires tls.addr and tls.client_ca_file",
+			"rate_limits.default must not be negative",
+		}, validationErr.Problems)
+	}
+}
+
+func TestTokensFromEnv(t *testing.T) {
+	hash, err := mw.HashToken("batch-token")
+	if !assert.NoError(t, err) {
+		return
+	}
+	t.Setenv("IRON_CONFIG", `{"project_id": "project", "token": "t", "cluster_info": [{"cluster_id": "c"}]}`)
+	t.Setenv("AUTH_TOKEN_STORE", `{"tokens": [{"name": "batch", "hash": "`+hash+`", "scopes": ["invoke:async"]}]}`)
+	config, err := Load("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{AuthToken}, config.Auth.Types, "token auth is the default")
+	if assert.Len(t, config.Auth.Token.Tokens, 1) {
+		assert.Equal(t, "batch", config.Auth.Token.Tokens[0].Name)
+	}
+}
+
+func TestLoadInvalidClusters(t *testing.T) {
+	_, err := Load(writeFile(t, "clusters.yaml", `
+iron:
+  project_id: project
+  token: iron-token
+  cluster_info:
+    - cluster_id: c1
+    - cluster_id: c1
+auth:
+  types: [token]
+  token:
+    token: secret
+clusters:
+  default:
+    strategy: fastest
+  functions:
+    reports:
+      strategy: pinned
+      cluster: c2
+    batch:
+      strategy: pinned
+`))
+	var validationErr *ValidationError
+	if assert.True(t, errors.As(err, &validationErr)) {
+		assert.Equal(t, []string{
+			`iron.cluster_info[1]: duplicate cluster_id "c1"`,
+			`clusters.default: unknown strategy "fastest"`,
+			`clusters.functions.batch: strategy "pinned" requires a cluster`,
+			`clusters.functions.reports: pinned cluster "c2" is not in iron.cluster_info`,
+		}, validationErr.Problems)
+	}
+}
+
+func TestLoadBackends(t *testing.T) {
+	cfg, err := Load(writeFile(t, "backends.yaml", `
+auth:
+  types: [token]
+  token:
+    token: secret
+backends:
+  team-a:
+    iron:
+      project_id: project-a
+      token: token-a
+      cluster_info:
+        - cluster_id: c1
+  team-b:
+    type: ferrite
+    iron:
+      base_url: http://ferrite:8080
+      token: token-b
+      cluster_info:
+        - {}
+default_backend: team-a
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"team-a", "team-b"}, cfg.BackendNames())
+	backends := cfg.BackendConfigs()
+	assert.Equal(t, BackendIron, backends["team-a"].Type)
+	assert.Equal(t, "project-a", backends["team-a"].Iron.ProjectID)
+	assert.Equal(t, BackendFerrite, backends["team-b"].Type)
+	name, backend := cfg.DefaultBackendConfig()
+	assert.Equal(t, "team-a", name)
+	assert.Equal(t, "token-a", backend.Iron.Token)
+
+	_, err = Load(writeFile(t, "invalid-backends.yaml", `
+iron:
+  project_id: project
+  token: iron-token
+  cluster_info:
+    - cluster_id: cluster
+auth:
+  types: [token]
+  token:
+    token: secret
+backends:
+  default:
+    iron:
+      project_id: p
+      token: t
+      cluster_info:
+        - cluster_id: c
+  Team:
+    type: lambda
+default_backend: other
+`))
+	var validationErr *ValidationError
+	if assert.True(t, errors.As(err, &validationErr)) {
+		assert.Equal(t, []string{
+			`backends: invalid name "Team", use lower case letters, digits, - and _`,
+			`backends.Team.type must be "iron" or "ferrite", got "lambda"`,
+			"backends.Team.iron.token is required",
+			"backends.Team.iron.cluster_info requires at least one cluster",
+			`backends: "default" is configured by iron and backend`,
+			`default_backend "other" is not configured`,
+		}, validationErr.Problems)
+	}
+}
+
+func TestTrustedNetworks(t *testing.T) {
+	cfg := &Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "::1"}}
+	networks, err := cfg.TrustedNetworks()
+	if assert.NoError(t, err) && assert.Len(t, networks, 3) {
+		assert.True(t, networks[0].Contains(net.ParseIP("10.1.2.3")))
+		assert.True(t, networks[1].Contains(net.ParseIP("192.168.1.1")))
+		assert.False(t, networks[1].Contains(net.ParseIP("192.168.1.2")))
+		assert.True(t, networks[2].Contains(net.ParseIP("::1")))
+	}
+
+	cfg.TrustedProxies = []string{"gorouter"}
+	_, err = cfg.TrustedNetworks()
+	assert.EqualError(t, err, `invalid trusted proxy "gorouter"`)
+}
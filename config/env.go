@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+)
+
+// env collects the environment overrides and the first error of an invalid value
+type env struct {
+	err error
+}
+
+func (e *env) string(name string, target *string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		*target = value
+	}
+}
+
+func (e *env) list(name string, target *[]string) {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*target = values
+	}
+}
+
+func (e *env) duration(name string, target *time.Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*target = d
+}
+
+func (e *env) int(name string, target *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*target = i
+}
+
+func (e *env) bool(name string, target *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(name, err)
+		return
+	}
+	*target = b
+}
+
+// json decodes a JSON document held in the named variable
+func (e *env) json(name string, target interface{}) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		e.fail(name, err)
+	}
+}
+
+// jsonFile decodes the JSON file named by the variable
+func (e *env) jsonFile(name string, target interface{}) {
+	file := os.Getenv(name)
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, target)
+	}
+	if err != nil {
+		e.fail(name, err)
+	}
+}
+
+func (e *env) fail(name string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid %s: %w", name, err)
+	}
+}
+
+// applyEnv overrides the configuration with the environment variables the gateway used before
+// configuration files were supported. Unset and empty variables leave the configuration as is
+func (c *Config) applyEnv() error {
+	e := &env{}
+	e.json("IRON_CONFIG", &c.Iron.Config)
+	e.string("BACKEND_TYPE", &c.Backend)
+	e.jsonFile("GATEWAY_BACKENDS_FILE", &c.Backends)
+	e.string("GATEWAY_DEFAULT_BACKEND", &c.DefaultBackend)
+	e.string("GATEWAY_LISTEN", &c.Listen)
+	e.list("GATEWAY_TRUSTED_PROXIES", &c.TrustedProxies)
+	e.string("GATEWAY_TLS_ADDR", &c.TLS.Addr)
+	e.string("GATEWAY_TLS_CERT_FILE", &c.TLS.CertFile)
+	e.string("GATEWAY_TLS_KEY_FILE", &c.TLS.KeyFile)
+	e.string("GATEWAY_TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile)
+	e.duration("GATEWAY_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	e.string("GATEWAY_TUNNEL_ADDR", &c.TunnelAddr)
+	e.string("GATEWAY_CLUSTER_STRATEGY", &c.Clusters.Default.Strategy)
+	e.bool("GATEWAY_CLUSTER_FAILOVER", &c.Clusters.Default.Failover)
+	e.string("GATEWAY_AUDIT_LOG", &c.AuditLog)
+	e.string("GATEWAY_POLICY_FILE", &c.PolicyFile)
+	e.jsonFile("GATEWAY_RATE_LIMIT_FILE", &c.RateLimits)
+	e.string("GATEWAY_LOG_LEVEL", &c.Logging.Level)
+	e.string("GATEWAY_LOG_FORMAT", &c.Logging.Format)
+	e.string("GATEWAY_TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	e.bool("GATEWAY_TRACING_INSECURE", &c.Tracing.Insecure)
+	e.string("OTEL_SERVICE_NAME", &c.Tracing.ServiceName)
+
+	auth := &c.Auth
+	e.list("GATEWAY_AUTH_TYPE", &auth.Types)
+	e.string("GATEWAY_AUTH_MODE", &auth.Mode)
+	e.string("AUTH_TOKEN_TOKEN", &auth.Token.Token)
+	e.string("AUTH_TOKEN_STORE_FILE", &auth.Token.StoreFile)
+	tokens := struct {
+		Tokens *[]mw.StoredToken `json:"tokens"`
+	}{Tokens: &auth.Token.Tokens}
+	e.json("AUTH_TOKEN_STORE", &tokens)
+
+	e.jsonFile("AUTH_IAM_CONFIG_FILE", &auth.IAM)
+	e.string("AUTH_IAM_CLIENT_ID", &auth.IAM.ClientID)
+	e.string("AUTH_IAM_CLIENT_SECRET", &auth.IAM.ClientSecret)
+	e.string("AUTH_IAM_REGION", &auth.IAM.Region)
+	e.string("AUTH_IAM_ENVIRONMENT", &auth.IAM.Environment)
+	e.list("AUTH_IAM_ORGS", &auth.IAM.Organizations)
+	e.list("AUTH_IAM_ROLES", &auth.IAM.Roles.AnyOf)
+	e.int("AUTH_IAM_CACHE_SIZE", &auth.IAMCache.Size)
+	e.duration("AUTH_IAM_CACHE_TTL", &auth.IAMCache.TTL)
+	e.duration("AUTH_IAM_NEGATIVE_CACHE_TTL", &auth.IAMCache.NegativeTTL)
+
+	e.string("AUTH_JWT_JWKS_URL", &auth.JWT.JWKSURL)
+	e.string("AUTH_JWT_JWKS_FILE", &auth.JWT.JWKSFile)
+	e.duration("AUTH_JWT_JWKS_REFRESH", &auth.JWT.JWKSRefresh)
+	e.string("AUTH_JWT_ISSUER", &auth.JWT.Issuer)
+	e.list("AUTH_JWT_AUDIENCES", &auth.JWT.Audiences)
+	e.list("AUTH_JWT_ORGS", &auth.JWT.Organizations)
+	e.list("AUTH_JWT_ROLES", &auth.JWT.Roles)
+	e.string("AUTH_JWT_ORGS_CLAIM", &auth.JWT.OrganizationsClaim)
+	e.string("AUTH_JWT_ROLES_CLAIM", &auth.JWT.RolesClaim)
+	e.duration("AUTH_JWT_LEEWAY", &auth.JWT.Leeway)
+
+	e.json("AUTH_SIGNED_KEYS", &auth.Signed.Keys)
+	e.duration("AUTH_SIGNED_MAX_CLOCK_SKEW", &auth.Signed.MaxClockSkew)
+	e.list("AUTH_SIGNED_REQUIRED_PARTS", &auth.Signed.RequiredParts)
+
+	e.list("AUTH_CERT_ALLOWED_SUBJECTS", &auth.Cert.AllowedSubjects)
+	e.list("AUTH_CERT_ALLOWED_SANS", &auth.Cert.AllowedSANs)
+	e.list("AUTH_CERT_SCOPES", &auth.Cert.Scopes)
+
+	e.string("CRON_STATE_FILE", &c.Cron.StateFile)
+	e.bool("CRON_SECONDS", &c.Cron.Seconds)
+	e.duration("CRON_JITTER", &c.Cron.Jitter)
+	return e.err
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	"github.com/philips-labs/hsdp-funcion-gateway/ratelimit"
+)
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+type problems []string
+
+func (p *problems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// Validate returns a *ValidationError when the configuration is incomplete or inconsistent
+func (c *Config) Validate() error {
+	var p problems
+
+	c.validateBackends(&p)
+	if c.Listen == "" {
+		p.add("listen is required")
+	}
+	if c.TLS.Addr != "" && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		p.add("tls.cert_file and tls.key_file are required with tls.addr")
+	}
+	if _, err := c.TrustedNetworks(); err != nil {
+		p.add("trusted_proxies: %v", err)
+	}
+	if c.ShutdownTimeout < 0 {
+		p.add("shutdown_timeout must not be negative")
+	}
+	c.Auth.validate(c, &p)
+	c.validateLimits(&p)
+	if c.Cron.Jitter < 0 || c.Cron.PollInterval < 0 || c.Cron.HistorySize < 0 {
+		p.add("cron durations and history_size must not be negative")
+	}
+	if _, err := logging.New(io.Discard, c.Logging); err != nil {
+		p.add("logging: %v", err)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		p.add("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if len(p) > 0 {
+		return &ValidationError{Problems: p}
+	}
+	return nil
+}
+
+func (a AuthConfig) validate(c *Config, p *problems) {
+	switch a.Mode {
+	case "", AuthModeAny, AuthModeAll:
+	default:
+		p.add("auth.mode must be %q or %q, got %q", AuthModeAny, AuthModeAll, a.Mode)
+	}
+	for _, authType := range a.Types {
+		switch authType {
+		case AuthNone:
+		case AuthToken:
+			if a.Token.Token == "" && a.Token.StoreFile == "" && len(a.Token.Tokens) == 0 {
+				p.add("token auth requires auth.token.token, auth.token.store_file or auth.token.tokens")
+			}
+		case AuthIAM:
+			if a.IAM.ClientID == "" || a.IAM.ClientSecret == "" {
+				p.add("iam auth requires auth.iam.client_id and auth.iam.client_secret")
+			}
+			if a.IAM.Region == "" && a.IAM.IAMURL == "" {
+				p.add("iam auth requires auth.iam.region or auth.iam.iam_url")
+			}
+		case AuthJWT:
+			if a.JWT.JWKSURL == "" && a.JWT.JWKSFile == "" {
+				p.add("jwt auth requires auth.jwt.jwks_url or auth.jwt.jwks_file")
+			}
+		case AuthSigned:
+			if len(a.Signed.Keys) == 0 {
+				p.add("signed auth requires at least one key in auth.signed.keys")
+			}
+			for i, k := range a.Signed.Keys {
+				if k.SharedKey == "" || k.SharedSecret == "" {
+					p.add("auth.signed.keys[%d] requires shared_key and shared_secret", i)
+				}
+			}
+		case AuthCert:
+			if c.TLS.Addr == "" || c.TLS.ClientCAFile == "" {
+				p.add("cert auth requires tls.addr and tls.client_ca_file")
+			}
+		default:
+			p.add("unknown auth type %q", authType)
+		}
+	}
+	if a.IAMCache.Size < 0 || a.IAMCache.TTL < 0 || a.IAMCache.NegativeTTL < 0 {
+		p.add("auth.iam_cache settings must not be negative")
+	}
+}
+
+// validateClusters validates the clusters of a backend, prefix is empty for the default backend
+func validateClusters(prefix string, b BackendConfig, p *problems) {
+	if b.Type == BackendFerrite && len(b.Iron.ClusterInfo) > 1 {
+		p.add("the ferrite backend bootstraps a single cluster, got %d in %siron.cluster_info", len(b.Iron.ClusterInfo), prefix)
+	}
+	ids := make(map[string]bool)
+	for i, cluster := range b.Iron.ClusterInfo {
+		if cluster.ClusterID == "" {
+			continue
+		}
+		if ids[cluster.ClusterID] {
+			p.add("%siron.cluster_info[%d]: duplicate cluster_id %q", prefix, i, cluster.ClusterID)
+		}
+		ids[cluster.ClusterID] = true
+	}
+	validSelection := func(name string, selection clusters.Selection) {
+		if err := selection.Validate(); err != nil {
+			p.add("%s: %v", name, err)
+			return
+		}
+		if selection.Strategy == clusters.StrategyPinned && b.Type != BackendFerrite && !ids[selection.Cluster] {
+			p.add("%s: pinned cluster %q is not in %siron.cluster_info", name, selection.Cluster, prefix)
+		}
+	}
+	validSelection(prefix+"clusters.default", b.Clusters.Default)
+	functions := make([]string, 0, len(b.Clusters.Functions))
+	for function := range b.Clusters.Functions {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+	for _, function := range functions {
+		validSelection(prefix+"clusters.functions."+function, b.Clusters.Functions[function])
+	}
+	if b.Clusters.StatsInterval < 0 {
+		p.add("%sclusters.stats_interval must not be negative", prefix)
+	}
+}
+
+func (c *Config) validateLimits(p *problems) {
+	validLimit := func(name string, limit ratelimit.Limit) {
+		if limit.Rate < 0 || limit.Burst < 0 || limit.DailyQuota < 0 {
+			p.add("%s must not be negative", name)
+		}
+	}
+	validLimit("rate_limits.default", c.RateLimits.Default)
+	principals := make([]string, 0, len(c.RateLimits.Principals))
+	for principal := range c.RateLimits.Principals {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+	for _, principal := range principals {
+		validLimit("rate_limits.principals."+principal, c.RateLimits.Principals[principal])
+	}
+}
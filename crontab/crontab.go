@@ -1,67 +1,281 @@
 package crontab
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cenkalti/backoff/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/philips-labs/hsdp-funcion-gateway/tracing"
 	siderite "github.com/philips-labs/siderite/models"
 	"github.com/philips-software/go-hsdp-api/iron"
 	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+const (
+	refreshRetryInterval = 1 * time.Second
+	refreshRetryWindow   = 20 * time.Second
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+)
+
+// Config configures the Crontab
+type Config struct {
+	// StateFile is where the pause state of schedules is persisted. Optional
+	StateFile string `json:"state_file,omitempty" yaml:"state_file,omitempty"`
+	// HistorySize is the number of runs kept per schedule. Defaults to 20
+	HistorySize int `json:"history_size,omitempty" yaml:"history_size,omitempty"`
+	// PollInterval is how often Iron is polled for the status of triggered tasks. Defaults to 10s
+	PollInterval time.Duration `json:"poll_interval,omitempty" yaml:"poll_interval,omitempty"`
+	// Seconds enables an optional leading seconds field in cron expressions.
+	// Descriptors such as @daily and @every 1h30m are always accepted
+	Seconds bool `json:"seconds,omitempty" yaml:"seconds,omitempty"`
+	// Jitter is the default window within which triggers are randomly delayed.
+	// Schedules can override it with a "jitter" duration in their payload
+	Jitter time.Duration `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// Backend names the backend of the crontab in its logs when the gateway runs several.
+	// Metrics label a crontab without a backend name "default"
+	Backend string `json:"-" yaml:"-"`
+}
+
+// Parser returns the cron expression parser for the configuration
+func (c Config) Parser() cron.Parser {
+	options := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor
+	if c.Seconds {
+		options |= cron.SecondOptional
+	}
+	return cron.NewParser(options)
+}
+
+// Crontab triggers Iron tasks for schedules carrying a cron expression
+type Crontab struct {
+	client *iron.Client
+	config Config
+	cron   *cron.Cron
+	log    *slog.Logger
+	// clusters selects the cluster of triggered tasks, the cluster of the schedule when nil
+	clusters *clusters.Selector
+
+	mu     sync.RWMutex
+	paused map[string]bool
+
+	historyMu sync.Mutex
+	history   map[string]*History
+
+	statusMu sync.Mutex
+	status   Status
+	invalid  map[string]invalidSchedule
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  atomic.Bool
+}
+
+// Entry describes an active crontab entry
+type Entry struct {
+	ScheduleID string    `json:"schedule_id"`
+	CodeName   string    `json:"code_name"`
+	Expression string    `json:"expression"`
+	Effective  string    `json:"effective_expression,omitempty"`
+	Jitter     string    `json:"jitter,omitempty"`
+	Next       time.Time `json:"next"`
+	Prev       time.Time `json:"prev"`
+	LastTaskID string    `json:"last_task_id,omitempty"`
+	LastStatus string    `json:"last_status,omitempty"`
+	Paused     bool      `json:"paused"`
+}
+
 type Job struct {
 	client      *iron.Client
+	crontab     *Crontab
 	ScheduleID  string
+	CodeName    string
 	CronPayload siderite.CronPayload
+	Spec        string
+	Jitter      time.Duration
+
+	mu         sync.Mutex
+	lastTaskID string
+	lastStatus string
+}
+
+type cronSchedule struct {
+	codeName string
+	payload  siderite.CronPayload
+	jitter   time.Duration
+	raw      string
+	err      error
+}
+
+// scheduleOptions are gateway specific settings in a schedule payload
+type scheduleOptions struct {
+	Jitter string `json:"jitter,omitempty"`
+}
+
+func (j *Job) Run() {
+	if j.crontab.IsPaused(j.ScheduleID) {
+		j.log().Info("schedule is paused, skipping run")
+		return
+	}
+	if delay := jitterDelay(j.Jitter); delay > 0 {
+		j.log().Debug("delaying trigger", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-j.crontab.stop:
+			j.log().Info("crontab stopped, skipping run")
+			return
+		}
+	}
+	_, _ = j.trigger()
 }
 
-func (j Job) Run() {
+func (j *Job) trigger() (taskID string, err error) {
+	run := RunRecord{TriggeredAt: time.Now()}
+	metrics.CronTriggers.WithLabelValues(j.ScheduleID, j.CodeName).Inc()
+	ctx, span := tracing.Start(context.Background(), "cron.trigger",
+		attribute.String("iron.schedule_id", j.ScheduleID),
+		attribute.String("iron.code_name", j.CodeName))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	_, lookup := tracing.Start(ctx, "iron.get_schedule")
 	schedule, _, err := j.client.Schedules.GetSchedule(j.ScheduleID)
+	metrics.ObserveIron("get_schedule", start, err)
+	tracing.End(lookup, err)
 	if err != nil {
-		fmt.Printf("Run %s: failed to find schedule: %v\n", j.ScheduleID, err)
-		return
+		j.log().Error("failed to find schedule", "error", err)
+		j.failed(run, err)
+		return "", err
 	}
-	task, _, err := j.client.Tasks.QueueTask(iron.Task{
+	task, err := j.crontab.clusters.Queue(*schedule, j.CronPayload.EncryptedPayload, iron.Task{
 		CodeName: schedule.CodeName,
-		Payload:  j.CronPayload.EncryptedPayload,
-		Cluster:  schedule.Cluster,
 		Timeout:  j.CronPayload.Timeout,
+	}, func(task iron.Task) (*iron.Task, *iron.Response, error) {
+		start := time.Now()
+		_, queue := tracing.Start(ctx, "iron.queue_task", attribute.String("iron.cluster", task.Cluster))
+		queued, resp, err := j.client.Tasks.QueueTask(task)
+		metrics.ObserveIron("queue_task", start, err)
+		tracing.End(queue, err)
+		return queued, resp, err
 	})
 	if err != nil {
-		fmt.Printf("Run %s: error queuing task: %v\n", j.ScheduleID, err)
-		return
+		j.log().Error("error queuing task", "error", err)
+		j.failed(run, err)
+		return "", err
+	}
+	metrics.TasksQueued.WithLabelValues("cron").Inc()
+	metrics.ClusterTasks.WithLabelValues(task.Cluster, "cron").Inc()
+	run.TaskID = task.ID
+	run.Cluster = task.Cluster
+	span.SetAttributes(attribute.String("iron.task_id", task.ID), attribute.String("iron.cluster", task.Cluster))
+	run.Status = task.Status
+	if run.Status == "" {
+		run.Status = "queued"
+	}
+	j.setLast(run.TaskID, run.Status)
+	j.log().Info("triggered task", "task_id", task.ID, "cluster", task.Cluster)
+	j.crontab.record(j.ScheduleID, run)
+	go j.crontab.track(j, run)
+	return task.ID, nil
+}
+
+func (j *Job) log() *slog.Logger {
+	return j.crontab.log.With("schedule_id", j.ScheduleID, "code_name", j.CodeName)
+}
+
+func (j *Job) failed(run RunRecord, err error) {
+	run.Status = "error"
+	run.Error = err.Error()
+	metrics.CronFailures.WithLabelValues(j.ScheduleID, j.CodeName).Inc()
+	j.setLast("", run.Status)
+	j.crontab.record(j.ScheduleID, run)
+}
+
+func (j *Job) setLast(taskID, status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lastTaskID = taskID
+	j.lastStatus = status
+}
+
+// setLastStatus updates the last status if taskID is still the last task
+func (j *Job) setLastStatus(taskID, status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.lastTaskID == taskID {
+		j.lastStatus = status
+	}
+}
+
+func (j *Job) last() (string, string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastTaskID, j.lastStatus
+}
+
+// New returns a Crontab which is not yet started
+func New(client *iron.Client, config Config) *Crontab {
+	c := &Crontab{
+		client:  client,
+		config:  config,
+		cron:    cron.New(cron.WithParser(config.Parser())),
+		paused:  make(map[string]bool),
+		history: make(map[string]*History),
+		invalid: make(map[string]invalidSchedule),
+		stop:    make(chan struct{}),
+		log:     slog.Default().With("component", "crontab"),
 	}
-	fmt.Printf("Run %s: triggered task %s\n", j.ScheduleID, task.ID)
+	if config.Backend != "" {
+		c.log = c.log.With("backend", config.Backend)
+	}
+	if err := c.loadState(); err != nil {
+		c.log.Error("error loading crontab state", "error", err)
+	}
+	return c
+}
+
+// SetClusterSelector sets the selector of the cluster of triggered tasks. Call it before Start
+func (c *Crontab) SetClusterSelector(selector *clusters.Selector) {
+	c.clusters = selector
 }
 
+// Start creates and starts a Crontab with the default configuration
 func Start(client *iron.Client) (chan bool, error) {
+	return New(client, Config{}).Start()
+}
+
+// Start starts the scheduler and the periodic refresh of Iron schedules
+func (c *Crontab) Start() (chan bool, error) {
 	ch := make(chan bool)
 	ticker := time.NewTicker(30 * time.Second)
-	crontab := cron.New()
-	crontab.Start()
+	c.cron.Start()
+	c.running.Store(true)
 
 	go func() {
-		fmt.Printf("Start crontab...\n")
+		defer c.running.Store(false)
+		c.log.Info("started crontab")
 		for {
 			select {
 			case <-ch:
-				fmt.Printf("exiting...\n")
+				c.log.Info("stopped crontab")
+				return
+			case <-c.stop:
+				ticker.Stop()
+				c.log.Info("stopped crontab")
 				return
 			case <-ticker.C: // Refresh
-				// Collect all cronjob entries
-				cronSchedules, err := getCronEntries(client)
-				if err != nil {
-					fmt.Printf("Error retrieving Iron schedules: %v\n", err)
-					continue
-				}
-				updateEntries(client, crontab, cronSchedules)
-				entries := crontab.Entries()
-				for _, e := range entries {
-					if job, ok := e.Job.(Job); ok {
-						fmt.Printf("Active entry %d: %s, next: %v\n", e.ID, job.ScheduleID, e.Next)
-					}
-				}
+				c.refresh()
 			}
 		}
 	}()
@@ -69,13 +283,146 @@ func Start(client *iron.Client) (chan bool, error) {
 	return ch, nil
 }
 
-func updateEntries(client *iron.Client, crontab *cron.Cron, schedules map[string]siderite.CronPayload) {
+// Stop stops the scheduler and waits for running jobs to finish or ctx to expire.
+// The pause state is flushed to the state file, also when waiting for jobs timed out
+func (c *Crontab) Stop(ctx context.Context) error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	var err error
+	running := c.cron.Stop()
+	select {
+	case <-running.Done():
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for running jobs: %w", ctx.Err())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return errors.Join(err, c.saveState())
+}
+
+// Running reports whether the crontab was started and not yet stopped
+func (c *Crontab) Running() bool {
+	return c.running.Load()
+}
+
+// Entries returns the active crontab entries
+func (c *Crontab) Entries() []Entry {
+	entries := make([]Entry, 0)
+	for _, e := range c.cron.Entries() {
+		job, ok := e.Job.(*Job)
+		if !ok {
+			continue
+		}
+		taskID, status := job.last()
+		entry := Entry{
+			ScheduleID: job.ScheduleID,
+			CodeName:   job.CodeName,
+			Expression: job.CronPayload.Schedule,
+			Next:       e.Next,
+			Prev:       e.Prev,
+			LastTaskID: taskID,
+			LastStatus: status,
+			Paused:     c.IsPaused(job.ScheduleID),
+		}
+		if job.Spec != job.CronPayload.Schedule {
+			entry.Effective = job.Spec
+		}
+		if job.Jitter > 0 {
+			entry.Jitter = job.Jitter.String()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Run triggers the job of a schedule immediately, regardless of its pause state
+func (c *Crontab) Run(scheduleID string) (string, error) {
+	job := c.findJob(scheduleID)
+	if job == nil {
+		return "", ErrScheduleNotFound
+	}
+	return job.trigger()
+}
+
+// Pause stops a schedule from triggering until it is resumed
+func (c *Crontab) Pause(scheduleID string) error {
+	return c.setPaused(scheduleID, true)
+}
+
+// Resume re-enables triggering of a paused schedule
+func (c *Crontab) Resume(scheduleID string) error {
+	return c.setPaused(scheduleID, false)
+}
+
+// IsPaused reports whether a schedule is paused
+func (c *Crontab) IsPaused(scheduleID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused[scheduleID]
+}
+
+func (c *Crontab) setPaused(scheduleID string, paused bool) error {
+	if c.findJob(scheduleID) == nil {
+		return ErrScheduleNotFound
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if paused {
+		c.paused[scheduleID] = true
+	} else {
+		delete(c.paused, scheduleID)
+	}
+	return c.saveState()
+}
+
+func (c *Crontab) findJob(scheduleID string) *Job {
+	for _, e := range c.cron.Entries() {
+		if job, ok := e.Job.(*Job); ok && job.ScheduleID == scheduleID {
+			return job
+		}
+	}
+	return nil
+}
+
+func (c *Crontab) refresh() {
+	var cronSchedules map[string]cronSchedule
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = refreshRetryInterval
+	b.MaxElapsedTime = refreshRetryWindow
+	err := backoff.RetryNotify(func() error {
+		var err error
+		cronSchedules, err = getCronEntries(c.client, c.log)
+		return err
+	}, b, func(err error, next time.Duration) {
+		c.log.Warn("error retrieving Iron schedules, retrying", "retry_in", next, "error", err)
+	})
+	c.refreshed(err)
+	if err != nil {
+		c.log.Error("error retrieving Iron schedules", "error", err)
+		return
+	}
+	c.updateEntries(cronSchedules)
+	entries := c.cron.Entries()
+	for _, e := range entries {
+		if job, ok := e.Job.(*Job); ok {
+			c.log.Debug("active entry", "entry_id", e.ID, "schedule_id", job.ScheduleID, "next", e.Next)
+		}
+	}
+}
+
+func (c *Crontab) updateEntries(schedules map[string]cronSchedule) {
+	crontab := c.cron
 	entries := crontab.Entries()
 	// Add new entries
-	for id, cronPayload := range schedules {
+	for id, s := range schedules {
+		if s.err != nil {
+			c.markInvalid(id, s)
+			continue
+		}
 		found := false
 		for _, e := range entries {
-			if job, ok := e.Job.(Job); ok {
+			if job, ok := e.Job.(*Job); ok {
 				if job.ScheduleID == id {
 					found = true
 					break
@@ -83,54 +430,93 @@ func updateEntries(client *iron.Client, crontab *cron.Cron, schedules map[string
 			}
 		}
 		if !found { // New cronjob
-			job := Job{
+			if c.knownInvalid(id, s) { // Only retry when the schedule changes
+				continue
+			}
+			spec, err := ExpandHash(s.payload.Schedule, id, c.config.Seconds)
+			if err != nil {
+				s.err = fmt.Errorf("invalid hash expression %q: %w", s.payload.Schedule, err)
+				c.markInvalid(id, s)
+				continue
+			}
+			jitter := c.config.Jitter
+			if s.jitter > 0 {
+				jitter = s.jitter
+			}
+			job := &Job{
 				ScheduleID:  id,
-				CronPayload: cronPayload,
-				client:      client,
+				CodeName:    s.codeName,
+				CronPayload: s.payload,
+				Spec:        spec,
+				Jitter:      jitter,
+				client:      c.client,
+				crontab:     c,
 			}
-			newID, err := crontab.AddJob(cronPayload.Schedule, job)
+			newID, err := crontab.AddJob(spec, job)
 			if err != nil {
-				fmt.Printf("error adding job %s: %v\n", id, err)
+				c.log.Error("error adding job", "schedule_id", id, "error", err)
+				s.err = fmt.Errorf("invalid cron expression %q: %w", s.payload.Schedule, err)
+				c.markInvalid(id, s)
+				continue
 			}
-			fmt.Printf("Added new job %d for schedule %s\n", newID, id)
+			c.clearInvalid(id)
+			c.log.Info("added job", "entry_id", newID, "schedule_id", id)
 		}
 	}
 	// Purge stale ones
 	entries = crontab.Entries()
 	for _, entry := range entries {
-		if job, ok := entry.Job.(Job); ok {
-			found := false
-			for id := range schedules {
-				if job.ScheduleID == id {
-					found = true
-					break
-				}
-			}
-			if !found { // Stale
-				fmt.Printf("Removing stale job %d for schedule %s\n", entry.ID, job.ScheduleID)
+		if job, ok := entry.Job.(*Job); ok {
+			if s, found := schedules[job.ScheduleID]; !found || s.err != nil { // Stale
+				c.log.Info("removing stale job", "entry_id", entry.ID, "schedule_id", job.ScheduleID)
 				crontab.Remove(entry.ID)
 			}
 		}
 	}
+	c.pruneInvalid(schedules)
 }
 
-func getCronEntries(client *iron.Client) (map[string]siderite.CronPayload, error) {
-	cronSchedules := make(map[string]siderite.CronPayload)
-	schedules, _, err := client.Schedules.GetSchedules()
+func getCronEntries(client *iron.Client, log *slog.Logger) (map[string]cronSchedule, error) {
+	cronSchedules := make(map[string]cronSchedule)
+	start := time.Now()
+	schedules, resp, err := client.Schedules.GetSchedules()
+	// Iron errors come with a JSON body, which the client does not report as an error
+	if err == nil && resp != nil && resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("listing schedules: %s", resp.Status)
+	}
+	metrics.ObserveIron("get_schedules", start, err)
 	if err != nil {
-		return cronSchedules, nil
+		return nil, err
 	}
 	for _, schedule := range *schedules {
 		var cronPayload siderite.CronPayload
 		err := json.Unmarshal([]byte(schedule.Payload), &cronPayload)
 		if err != nil {
+			cronSchedules[schedule.ID] = cronSchedule{
+				codeName: schedule.CodeName,
+				raw:      schedule.Payload,
+				err:      fmt.Errorf("unparsable payload: %w", err),
+			}
 			continue
 		}
 		if cronPayload.Schedule == "" {
-			fmt.Printf("[%s] is not a cron schedule. skipping\n", schedule.ID)
+			log.Debug("not a cron schedule, skipping", "schedule_id", schedule.ID)
 			continue
 		}
-		cronSchedules[schedule.ID] = cronPayload
+		s := cronSchedule{
+			codeName: schedule.CodeName,
+			payload:  cronPayload,
+			raw:      schedule.Payload,
+		}
+		var options scheduleOptions
+		_ = json.Unmarshal([]byte(schedule.Payload), &options)
+		if options.Jitter != "" {
+			s.jitter, err = time.ParseDuration(options.Jitter)
+			if err != nil {
+				s.err = fmt.Errorf("invalid jitter %q: %w", options.Jitter, err)
+			}
+		}
+		cronSchedules[schedule.ID] = s
 	}
 	return cronSchedules, nil
 }
@@ -1,12 +1,20 @@
 package crontab
 
 import (
+	"context"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	siderite "github.com/philips-labs/siderite/models"
 	"github.com/philips-software/go-hsdp-api/iron"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robfig/cron/v3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -88,3 +96,367 @@ func TestCrontabRefresh(t *testing.T) {
 	}
 	done <- true
 }
+
+func TestCrontabPauseResume(t *testing.T) {
+	var scheduleID = "yyy-yyy"
+
+	teardown := setup(t)
+	defer teardown()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	ct := New(client, Config{StateFile: stateFile})
+	ct.updateEntries(map[string]cronSchedule{
+		scheduleID: {
+			codeName: "testandy",
+			payload:  siderite.CronPayload{Schedule: "0 * * * *"},
+		},
+	})
+
+	entries := ct.Entries()
+	if !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Equal(t, scheduleID, entries[0].ScheduleID)
+	assert.Equal(t, "testandy", entries[0].CodeName)
+	assert.Equal(t, "0 * * * *", entries[0].Expression)
+	assert.False(t, entries[0].Paused)
+
+	assert.ErrorIs(t, ct.Pause("unknown"), ErrScheduleNotFound)
+	assert.NoError(t, ct.Pause(scheduleID))
+	assert.True(t, ct.IsPaused(scheduleID))
+
+	// Pause state survives a restart
+	restarted := New(client, Config{StateFile: stateFile})
+	assert.True(t, restarted.IsPaused(scheduleID))
+
+	assert.NoError(t, ct.Resume(scheduleID))
+	restarted = New(client, Config{StateFile: stateFile})
+	assert.False(t, restarted.IsPaused(scheduleID))
+}
+
+func TestCrontabRunHistory(t *testing.T) {
+	var scheduleID = "zzz-zzz"
+	var taskID = "bFp7OMpXdVsvRHp4sVtqb3gV"
+
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules", scheduleID), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"id":"`+scheduleID+`","code_name":"testandy","cluster":"XKaaLazEd1sAUAyZZN8IG6Tg"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal(t, "POST", r.Method) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"tasks":[{"id":"`+taskID+`"}],"msg":"Queued up"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks", taskID), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{
+      "id": "`+taskID+`",
+      "status": "error",
+      "msg": "exit status 1",
+      "code_name": "testandy",
+      "start_time": "2020-06-23T09:47:11.85Z",
+      "end_time": "2020-06-23T09:47:41.85Z"
+    }`)
+	})
+
+	ct := New(client, Config{PollInterval: 10 * time.Millisecond})
+	ct.updateEntries(map[string]cronSchedule{
+		scheduleID: {
+			codeName: "testandy",
+			payload:  siderite.CronPayload{Schedule: "0 * * * *"},
+		},
+	})
+
+	triggered, err := ct.Run(scheduleID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, taskID, triggered)
+
+	assert.Eventually(t, func() bool {
+		history, err := ct.History(scheduleID)
+		return err == nil && history.Failed == 1
+	}, time.Second, 10*time.Millisecond)
+
+	history, _ := ct.History(scheduleID)
+	if !assert.Len(t, history.Runs, 1) {
+		return
+	}
+	assert.Equal(t, "error", history.Runs[0].Status)
+	assert.Equal(t, "exit status 1", history.Runs[0].Error)
+	assert.Equal(t, 30.0, history.Runs[0].DurationSeconds)
+	assert.Equal(t, 0, history.Succeeded)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CronRuns.WithLabelValues(scheduleID, "failed")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.CronRuns.WithLabelValues(scheduleID, "succeeded")))
+
+	entries := ct.Entries()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, taskID, entries[0].LastTaskID)
+		assert.Equal(t, "error", entries[0].LastStatus)
+	}
+}
+
+func TestCrontabRunMetrics(t *testing.T) {
+	var scheduleID = "succeeding"
+
+	teardown := setup(t)
+	defer teardown()
+
+	ct := New(client, Config{})
+	start := time.Now().Unix()
+	ct.record(scheduleID, RunRecord{TriggeredAt: time.Now(), TaskID: "t1", Status: "running"})
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.CronRuns.WithLabelValues(scheduleID, "succeeded")), "unfinished runs are not counted")
+	ct.update(scheduleID, RunRecord{TaskID: "t1", Status: "complete"})
+	ct.record(scheduleID, RunRecord{TaskID: "t2", Status: "timeout"})
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CronRuns.WithLabelValues(scheduleID, "succeeded")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CronRuns.WithLabelValues(scheduleID, "failed")))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.CronLastSuccess.WithLabelValues(scheduleID)), float64(start))
+}
+
+func TestCrontabInvalidSchedules(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ct := New(client, Config{Backend: "invalid"})
+	invalid := metrics.CronInvalidSchedules.WithLabelValues("invalid")
+	schedules := map[string]cronSchedule{
+		"bad-expression": {
+			codeName: "testandy",
+			payload:  siderite.CronPayload{Schedule: "every hour"},
+			raw:      `{"schedule":"every hour"}`,
+		},
+		"seconds": {
+			codeName: "testandy",
+			payload:  siderite.CronPayload{Schedule: "*/5 * * * * *"},
+			raw:      `{"schedule":"*/5 * * * * *"}`,
+		},
+		"descriptor": {
+			codeName: "testandy",
+			payload:  siderite.CronPayload{Schedule: "@every 1h30m"},
+			raw:      `{"schedule":"@every 1h30m"}`,
+		},
+	}
+	ct.updateEntries(schedules)
+
+	status := ct.Status()
+	assert.Equal(t, 1, status.Active)
+	if !assert.Len(t, status.Invalid, 2) {
+		return
+	}
+	assert.Equal(t, "bad-expression", status.Invalid[0].ScheduleID)
+	assert.Equal(t, "every hour", status.Invalid[0].Expression)
+	since := status.Invalid[0].Since
+	assert.Equal(t, float64(2), testutil.ToFloat64(invalid))
+
+	// Unchanged invalid schedules are not retried
+	ct.updateEntries(schedules)
+	status = ct.Status()
+	assert.Len(t, status.Invalid, 2)
+	assert.Equal(t, since, status.Invalid[0].Since)
+
+	// Removed schedules are no longer invalid
+	delete(schedules, "bad-expression")
+	ct.updateEntries(schedules)
+	assert.Equal(t, float64(1), testutil.ToFloat64(invalid))
+	schedules["bad-expression"] = cronSchedule{
+		codeName: "testandy",
+		payload:  siderite.CronPayload{Schedule: "every hour"},
+		raw:      `{"schedule":"every hour"}`,
+	}
+
+	// Seconds are opt-in
+	ct = New(client, Config{Backend: "invalid", Seconds: true})
+	ct.updateEntries(schedules)
+	status = ct.Status()
+	assert.Equal(t, 2, status.Active)
+	assert.Len(t, status.Invalid, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(invalid))
+}
+
+func TestGetCronEntriesIronError(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"msg":"Invalid token"}`)
+	})
+	// An error response must not be taken for an empty set of schedules, which would remove every entry
+	schedules, err := getCronEntries(client, slog.Default())
+	assert.Error(t, err)
+	assert.Nil(t, schedules)
+}
+
+func TestExpandHash(t *testing.T) {
+	spec, err := ExpandHash("H H * * *", "schedule-a", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	again, _ := ExpandHash("H H * * *", "schedule-a", false)
+	assert.Equal(t, spec, again, "expansion must be deterministic")
+	_, err = cron.ParseStandard(spec)
+	assert.NoError(t, err)
+
+	spread := make(map[string]bool)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		spec, err := ExpandHash("H * * * *", key, false)
+		if assert.NoError(t, err) {
+			spread[spec] = true
+		}
+	}
+	assert.Greater(t, len(spread), 1, "identical expressions should be spread")
+
+	spec, err = ExpandHash("H(0-29)/10 H(2-4) * * *", "schedule-a", false)
+	if assert.NoError(t, err) {
+		_, err = cron.ParseStandard(spec)
+		assert.NoError(t, err)
+	}
+
+	spec, err = ExpandHash("H */5 * * * *", "schedule-a", true)
+	if assert.NoError(t, err) {
+		_, err = Config{Seconds: true}.Parser().Parse(spec)
+		assert.NoError(t, err)
+	}
+
+	unchanged, err := ExpandHash("@every 1h", "schedule-a", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "@every 1h", unchanged)
+
+	_, err = ExpandHash("H(30-70) * * * *", "schedule-a", false)
+	assert.Error(t, err)
+	_, err = ExpandHash("H/x * * * *", "schedule-a", false)
+	assert.Error(t, err)
+}
+
+func TestConfigNext(t *testing.T) {
+	from := time.Date(2023, 8, 1, 10, 30, 0, 0, time.UTC)
+	effective, times, err := Config{}.Next("0 */6 * * *", "", from, 3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0 */6 * * *", effective)
+		assert.Equal(t, []time.Time{
+			time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC),
+			time.Date(2023, 8, 1, 18, 0, 0, 0, time.UTC),
+			time.Date(2023, 8, 2, 0, 0, 0, 0, time.UTC),
+		}, times)
+	}
+
+	effective, times, err = Config{}.Next("H 2 * * *", "schedule-a", from, 1)
+	if assert.NoError(t, err) {
+		expanded, _ := ExpandHash("H 2 * * *", "schedule-a", false)
+		assert.Equal(t, expanded, effective)
+		assert.Len(t, times, 1)
+	}
+
+	_, _, err = Config{}.Next("*/5 * * * * *", "", from, 1)
+	assert.Error(t, err, "seconds require the seconds option")
+	_, times, err = Config{Seconds: true}.Next("*/5 * * * * *", "", from, 2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, from.Add(5*time.Second), times[0])
+	}
+}
+
+func TestCrontabJitter(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ct := New(client, Config{Jitter: time.Minute})
+	ct.updateEntries(map[string]cronSchedule{
+		"default": {
+			payload: siderite.CronPayload{Schedule: "H * * * *"},
+		},
+		"override": {
+			payload: siderite.CronPayload{Schedule: "0 * * * *"},
+			jitter:  5 * time.Minute,
+		},
+	})
+	entries := make(map[string]Entry)
+	for _, e := range ct.Entries() {
+		entries[e.ScheduleID] = e
+	}
+	assert.Equal(t, "1m0s", entries["default"].Jitter)
+	assert.NotEmpty(t, entries["default"].Effective)
+	assert.Equal(t, "5m0s", entries["override"].Jitter)
+	assert.Empty(t, entries["override"].Effective)
+}
+
+func TestCrontabStop(t *testing.T) {
+	var scheduleID = "yyy-yyy"
+
+	teardown := setup(t)
+	defer teardown()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	ct := New(client, Config{StateFile: stateFile})
+	_, err := ct.Start()
+	if !assert.NoError(t, err) {
+		return
+	}
+	ct.updateEntries(map[string]cronSchedule{
+		scheduleID: {payload: siderite.CronPayload{Schedule: "0 * * * *"}},
+	})
+	assert.NoError(t, ct.Pause(scheduleID))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, ct.Stop(ctx))
+	assert.NoError(t, ct.Stop(ctx), "stop must be idempotent")
+
+	restarted := New(client, Config{StateFile: stateFile})
+	assert.True(t, restarted.IsPaused(scheduleID))
+}
+
+// immediately fires once
+type immediately struct {
+	fired bool
+}
+
+func (s *immediately) Next(t time.Time) time.Time {
+	if s.fired {
+		return t.AddDate(1, 0, 0)
+	}
+	s.fired = true
+	return t
+}
+
+func TestCrontabStopTimeout(t *testing.T) {
+	var scheduleID = "yyy-yyy"
+
+	teardown := setup(t)
+	defer teardown()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	ct := New(client, Config{StateFile: stateFile})
+	_, err := ct.Start()
+	if !assert.NoError(t, err) {
+		return
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	ct.cron.Schedule(&immediately{}, cron.FuncJob(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	// paused without saving, Stop has to flush it
+	ct.mu.Lock()
+	ct.paused[scheduleID] = true
+	ct.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, ct.Stop(ctx), context.DeadlineExceeded)
+
+	restarted := New(client, Config{StateFile: stateFile})
+	assert.True(t, restarted.IsPaused(scheduleID), "state is saved when running jobs overrun the timeout")
+}
@@ -0,0 +1,174 @@
+package crontab
+
+import (
+	"time"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+)
+
+const (
+	defaultHistorySize  = 20
+	defaultPollInterval = 10 * time.Second
+	maxPollDuration     = 2 * time.Hour
+)
+
+// RunRecord records the outcome of a single triggered task
+type RunRecord struct {
+	TriggeredAt     time.Time `json:"triggered_at"`
+	TaskID          string    `json:"task_id,omitempty"`
+	Cluster         string    `json:"cluster,omitempty"`
+	Status          string    `json:"status"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Finished reports whether the task reached a final state
+func (r RunRecord) Finished() bool {
+	return isFinalStatus(r.Status)
+}
+
+// Succeeded reports whether the task completed successfully
+func (r RunRecord) Succeeded() bool {
+	return r.Status == "complete"
+}
+
+// History is the run history of a schedule, most recent run first
+type History struct {
+	ScheduleID string      `json:"schedule_id"`
+	Succeeded  int         `json:"succeeded"`
+	Failed     int         `json:"failed"`
+	Runs       []RunRecord `json:"runs"`
+}
+
+func isFinalStatus(status string) bool {
+	switch status {
+	case "complete", "error", "cancelled", "killed", "timeout":
+		return true
+	}
+	return false
+}
+
+// History returns the run history of a schedule
+func (c *Crontab) History(scheduleID string) (*History, error) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	h, ok := c.history[scheduleID]
+	if !ok {
+		if c.findJob(scheduleID) == nil {
+			return nil, ErrScheduleNotFound
+		}
+		return &History{ScheduleID: scheduleID, Runs: []RunRecord{}}, nil
+	}
+	runs := make([]RunRecord, len(h.Runs))
+	copy(runs, h.Runs)
+	return &History{
+		ScheduleID: scheduleID,
+		Succeeded:  h.Succeeded,
+		Failed:     h.Failed,
+		Runs:       runs,
+	}, nil
+}
+
+func (c *Crontab) historySize() int {
+	if c.config.HistorySize > 0 {
+		return c.config.HistorySize
+	}
+	return defaultHistorySize
+}
+
+func (c *Crontab) pollInterval() time.Duration {
+	if c.config.PollInterval > 0 {
+		return c.config.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// record adds a run to the history of a schedule
+func (c *Crontab) record(scheduleID string, r RunRecord) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	h, ok := c.history[scheduleID]
+	if !ok {
+		h = &History{ScheduleID: scheduleID}
+		c.history[scheduleID] = h
+	}
+	h.Runs = append([]RunRecord{r}, h.Runs...)
+	if size := c.historySize(); len(h.Runs) > size {
+		h.Runs = h.Runs[:size]
+	}
+	c.countOutcome(h, r)
+}
+
+// update replaces the run of taskID in the history of a schedule
+func (c *Crontab) update(scheduleID string, r RunRecord) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	h, ok := c.history[scheduleID]
+	if !ok {
+		return
+	}
+	for i := range h.Runs {
+		if h.Runs[i].TaskID == r.TaskID {
+			h.Runs[i] = r
+			c.countOutcome(h, r)
+			return
+		}
+	}
+}
+
+// countOutcome counts a finished run in the history and the metrics. It must be called with c.historyMu held
+func (c *Crontab) countOutcome(h *History, r RunRecord) {
+	if !r.Finished() {
+		return
+	}
+	if r.Succeeded() {
+		h.Succeeded++
+		metrics.CronRuns.WithLabelValues(h.ScheduleID, "succeeded").Inc()
+		metrics.CronLastSuccess.WithLabelValues(h.ScheduleID).SetToCurrentTime()
+		c.log.Info("task completed", "schedule_id", h.ScheduleID, "task_id", r.TaskID, "duration_seconds", r.DurationSeconds)
+		return
+	}
+	h.Failed++
+	metrics.CronRuns.WithLabelValues(h.ScheduleID, "failed").Inc()
+	c.log.Warn("task failed", "schedule_id", h.ScheduleID, "task_id", r.TaskID, "status", r.Status, "error", r.Error)
+}
+
+// track polls Iron until the task of a run reaches a final state
+func (c *Crontab) track(job *Job, r RunRecord) {
+	ticker := time.NewTicker(c.pollInterval())
+	defer ticker.Stop()
+	deadline := time.After(maxPollDuration)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-deadline:
+			job.log().Warn("gave up tracking task", "task_id", r.TaskID)
+			return
+		case <-ticker.C:
+			start := time.Now()
+			task, _, err := c.client.Tasks.GetTask(r.TaskID)
+			metrics.ObserveIron("get_task", start, err)
+			if err != nil {
+				job.log().Warn("error retrieving task", "task_id", r.TaskID, "error", err)
+				continue
+			}
+			if !isFinalStatus(task.Status) {
+				continue
+			}
+			r.Status = task.Status
+			if task.StartTime != nil && task.EndTime != nil && task.EndTime.After(*task.StartTime) {
+				r.DurationSeconds = task.EndTime.Sub(*task.StartTime).Seconds()
+			} else {
+				r.DurationSeconds = time.Since(r.TriggeredAt).Seconds()
+			}
+			if !r.Succeeded() {
+				r.Error = task.Msg
+				metrics.CronFailures.WithLabelValues(job.ScheduleID, job.CodeName).Inc()
+			}
+			job.setLastStatus(r.TaskID, r.Status)
+			c.update(job.ScheduleID, r)
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package crontab
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fieldBounds struct {
+	min, max int
+}
+
+var (
+	// Day of month is capped at 28 so hashed values fire every month
+	standardBounds = []fieldBounds{{0, 59}, {0, 23}, {1, 28}, {1, 12}, {0, 6}}
+	secondBounds   = fieldBounds{0, 59}
+)
+
+// ExpandHash replaces H tokens in a cron expression by values derived from
+// the hash of key, spreading schedules with identical expressions over their
+// range. Supported forms are H, H/step, H(min-max) and H(min-max)/step
+func ExpandHash(spec, key string, seconds bool) (string, error) {
+	if !strings.Contains(spec, "H") || strings.HasPrefix(spec, "@") {
+		return spec, nil
+	}
+	fields := strings.Fields(spec)
+	bounds := standardBounds
+	if seconds && len(fields) == 6 {
+		bounds = append([]fieldBounds{secondBounds}, standardBounds...)
+	}
+	if len(fields) != len(bounds) {
+		return spec, fmt.Errorf("expected %d fields, found %d: %s", len(bounds), len(fields), spec)
+	}
+	for i, field := range fields {
+		if !strings.HasPrefix(field, "H") {
+			continue
+		}
+		expanded, err := expandHashField(field, bounds[i], hashOf(key, i))
+		if err != nil {
+			return spec, fmt.Errorf("field %d: %w", i+1, err)
+		}
+		fields[i] = expanded
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func expandHashField(field string, b fieldBounds, hash uint32) (string, error) {
+	rest := strings.TrimPrefix(field, "H")
+	if strings.HasPrefix(rest, "(") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated range in %s", field)
+		}
+		lo, hi, found := strings.Cut(rest[1:end], "-")
+		if !found {
+			return "", fmt.Errorf("invalid range in %s", field)
+		}
+		min, err := strconv.Atoi(lo)
+		if err != nil {
+			return "", fmt.Errorf("invalid range in %s", field)
+		}
+		max, err := strconv.Atoi(hi)
+		if err != nil {
+			return "", fmt.Errorf("invalid range in %s", field)
+		}
+		if min < b.min || max > b.max || min > max {
+			return "", fmt.Errorf("range out of bounds in %s", field)
+		}
+		b = fieldBounds{min, max}
+		rest = rest[end+1:]
+	}
+	switch {
+	case rest == "":
+		return strconv.Itoa(b.min + int(hash%uint32(b.max-b.min+1))), nil
+	case strings.HasPrefix(rest, "/"):
+		step, err := strconv.Atoi(rest[1:])
+		if err != nil || step <= 0 {
+			return "", fmt.Errorf("invalid step in %s", field)
+		}
+		start := b.min + int(hash%uint32(step))
+		if start > b.max {
+			start = b.max
+		}
+		return fmt.Sprintf("%d-%d/%d", start, b.max, step), nil
+	}
+	return "", fmt.Errorf("invalid hash expression %s", field)
+}
+
+func hashOf(key string, field int) uint32 {
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s/%d", key, field)
+	return h.Sum32()
+}
+
+// jitterDelay returns a random delay in [0, window)
+func jitterDelay(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// Next returns the effective expression of spec, with H tokens expanded for key,
+// and its next n trigger times after from
+func (c Config) Next(spec, key string, from time.Time, n int) (string, []time.Time, error) {
+	effective, err := ExpandHash(spec, key, c.Seconds)
+	if err != nil {
+		return spec, nil, err
+	}
+	schedule, err := c.Parser().Parse(effective)
+	if err != nil {
+		return effective, nil, err
+	}
+	times := make([]time.Time, 0, n)
+	for next := from; len(times) < n; {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		times = append(times, next)
+	}
+	return effective, times, nil
+}
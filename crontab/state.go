@@ -0,0 +1,67 @@
+package crontab
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type state struct {
+	Paused []string `json:"paused"`
+}
+
+func (c *Crontab) loadState() error {
+	if c.config.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range s.Paused {
+		c.paused[id] = true
+	}
+	return nil
+}
+
+// saveState must be called with c.mu held
+func (c *Crontab) saveState() error {
+	if c.config.StateFile == "" {
+		return nil
+	}
+	s := state{Paused: make([]string, 0, len(c.paused))}
+	for id := range c.paused {
+		s.Paused = append(s.Paused, id)
+	}
+	sort.Strings(s.Paused)
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.config.StateFile), ".crontab-state-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.config.StateFile)
+}
@@ -0,0 +1,116 @@
+package crontab
+
+import (
+	"sort"
+	"time"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+)
+
+// defaultBackend labels the metrics of a crontab without a backend name
+const defaultBackend = "default"
+
+// InvalidSchedule describes a schedule which could not be added to the crontab
+type InvalidSchedule struct {
+	ScheduleID string    `json:"schedule_id"`
+	CodeName   string    `json:"code_name"`
+	Expression string    `json:"expression,omitempty"`
+	Error      string    `json:"error"`
+	Since      time.Time `json:"since"`
+}
+
+// Status summarises the health of the crontab
+type Status struct {
+	Running             bool              `json:"running"`
+	LastRefresh         time.Time         `json:"last_refresh"`
+	LastRefreshError    string            `json:"last_refresh_error,omitempty"`
+	RefreshFailures     int               `json:"refresh_failures"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	Active              int               `json:"active"`
+	Invalid             []InvalidSchedule `json:"invalid"`
+}
+
+type invalidSchedule struct {
+	InvalidSchedule
+	raw string
+}
+
+// Status returns the current status of the crontab
+func (c *Crontab) Status() Status {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	status := c.status
+	status.Running = c.Running()
+	status.Active = len(c.cron.Entries())
+	status.Invalid = make([]InvalidSchedule, 0, len(c.invalid))
+	for _, i := range c.invalid {
+		status.Invalid = append(status.Invalid, i.InvalidSchedule)
+	}
+	sort.Slice(status.Invalid, func(i, j int) bool {
+		return status.Invalid[i].ScheduleID < status.Invalid[j].ScheduleID
+	})
+	return status
+}
+
+func (c *Crontab) refreshed(err error) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if err != nil {
+		c.status.LastRefreshError = err.Error()
+		c.status.RefreshFailures++
+		metrics.CronRefreshFailures.Inc()
+		c.status.ConsecutiveFailures++
+		return
+	}
+	c.status.LastRefresh = time.Now()
+	c.status.LastRefreshError = ""
+	c.status.ConsecutiveFailures = 0
+}
+
+func (c *Crontab) markInvalid(scheduleID string, s cronSchedule) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if i, ok := c.invalid[scheduleID]; ok && i.raw == s.raw {
+		return
+	}
+	c.log.Warn("invalid cron schedule", "schedule_id", scheduleID, "error", s.err)
+	c.invalid[scheduleID] = invalidSchedule{
+		InvalidSchedule: InvalidSchedule{
+			ScheduleID: scheduleID,
+			CodeName:   s.codeName,
+			Expression: s.payload.Schedule,
+			Error:      s.err.Error(),
+			Since:      time.Now(),
+		},
+		raw: s.raw,
+	}
+}
+
+// knownInvalid reports whether the schedule was rejected before and is unchanged since
+func (c *Crontab) knownInvalid(scheduleID string, s cronSchedule) bool {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	i, ok := c.invalid[scheduleID]
+	return ok && i.raw == s.raw
+}
+
+func (c *Crontab) clearInvalid(scheduleID string) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	delete(c.invalid, scheduleID)
+}
+
+func (c *Crontab) pruneInvalid(schedules map[string]cronSchedule) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	for id := range c.invalid {
+		if _, ok := schedules[id]; !ok {
+			delete(c.invalid, id)
+		}
+	}
+	backend := c.config.Backend
+	if backend == "" {
+		backend = defaultBackend
+	}
+	metrics.CronInvalidSchedules.WithLabelValues(backend).Set(float64(len(c.invalid)))
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	siderite "github.com/philips-labs/siderite/models"
+	"github.com/philips-software/go-hsdp-api/iron"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Task listing limits of AdminTasks
+const (
+	defaultTaskLimit = 20
+	maxTaskLimit     = 100
+	// maxTaskPages bounds the pages of tasks listed for a code
+	maxTaskPages = 10
+)
+
+// Schedule types
+const (
+	ScheduleSync  = "sync"
+	ScheduleAsync = "async"
+	ScheduleCron  = "cron"
+)
+
+// CodeInfo describes a code package
+type CodeInfo struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Image        string     `json:"image"`
+	Revision     int        `json:"revision"`
+	LatestChange *time.Time `json:"latest_change,omitempty"`
+}
+
+// CodeDetail is a code package with its schedules
+type CodeDetail struct {
+	CodeInfo
+	Schedules []ScheduleInfo `json:"schedules"`
+}
+
+// ScheduleInfo describes a schedule decoded from its CronPayload. The encrypted payload is never included
+type ScheduleInfo struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Expression  string     `json:"expression,omitempty"`
+	Timeout     int        `json:"timeout,omitempty"`
+	Cluster     string     `json:"cluster,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	NextStart   *time.Time `json:"next_start,omitempty"`
+	LastRunTime *time.Time `json:"last_run_time,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// TaskInfo describes a task without its payload
+type TaskInfo struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Msg        string     `json:"msg,omitempty"`
+	ScheduleID string     `json:"schedule_id,omitempty"`
+	Cluster    string     `json:"cluster,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	StartTime  *time.Time `json:"start_time,omitempty"`
+	EndTime    *time.Time `json:"end_time,omitempty"`
+	Duration   int        `json:"duration,omitempty"`
+}
+
+// AdminCodes lists the code packages of the project
+func AdminCodes(client *iron.Client) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		done := ironCall(ctx.Request().Context(), "get_codes")
+		codes, resp, err := client.Codes.GetCodes()
+		done(err)
+		if err := ironError(resp, err, "codes"); err != nil {
+			return err
+		}
+		infos := make([]CodeInfo, 0, len(*codes))
+		for _, code := range *codes {
+			infos = append(infos, codeInfo(code))
+		}
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Name < infos[j].Name
+		})
+		return ctx.JSON(http.StatusOK, infos)
+	}
+}
+
+// AdminCode returns a code package with its sync, async and cron schedules
+func AdminCode(client *iron.Client) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		code, err := getCode(ctx, client)
+		if err != nil {
+			return err
+		}
+		done := ironCall(ctx.Request().Context(), "get_schedules", attribute.String("iron.code_name", code.Name))
+		schedules, resp, err := client.Schedules.GetSchedulesWithCode(code.Name)
+		done(err)
+		if err := ironError(resp, err, "schedules"); err != nil {
+			return err
+		}
+		detail := CodeDetail{
+			CodeInfo:  codeInfo(*code),
+			Schedules: make([]ScheduleInfo, 0, len(*schedules)),
+		}
+		for _, schedule := range *schedules {
+			detail.Schedules = append(detail.Schedules, DecodeSchedule(schedule))
+		}
+		return ctx.JSON(http.StatusOK, detail)
+	}
+}
+
+// AdminTasks lists the most recent tasks of a code package, newest first. The
+// number of tasks is set with the limit query parameter, which defaults to 20
+func AdminTasks(client *iron.Client, config *iron.Config) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		limit := defaultTaskLimit
+		if value := ctx.QueryParam("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxTaskLimit {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxTaskLimit))
+			}
+			limit = n
+		}
+		code, err := getCode(ctx, client)
+		if err != nil {
+			return err
+		}
+		tasks, err := codeTasks(ctx.Request().Context(), client, config, code, limit)
+		if err != nil {
+			return err
+		}
+		infos := make([]TaskInfo, 0, len(tasks))
+		for _, task := range tasks {
+			infos = append(infos, TaskInfo{
+				ID:         task.ID,
+				Status:     task.Status,
+				Msg:        task.Msg,
+				ScheduleID: task.ScheduleID,
+				Cluster:    task.Cluster,
+				CreatedAt:  task.CreatedAt,
+				StartTime:  task.StartTime,
+				EndTime:    task.EndTime,
+				Duration:   task.Duration,
+			})
+		}
+		sort.SliceStable(infos, func(i, j int) bool {
+			return createdAt(infos[i]).After(createdAt(infos[j]))
+		})
+		if len(infos) > limit {
+			infos = infos[:limit]
+		}
+		return ctx.JSON(http.StatusOK, infos)
+	}
+}
+
+// codeTasks returns up to limit tasks of code. The client only lists the first page of the
+// tasks of the whole project, so tasks are listed by code name, page by page. Tasks of other
+// codes are skipped as well, in case the server ignores the code name
+func codeTasks(ctx context.Context, client *iron.Client, config *iron.Config, code *iron.Code, limit int) ([]iron.Task, error) {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = iron.IronBaseURL
+	}
+	endpoint := strings.TrimSuffix(baseURL, "/") + client.Path("projects", config.ProjectID, "tasks")
+	tasks := make([]iron.Task, 0, limit)
+	for page := 0; page < maxTaskPages && len(tasks) < limit; page++ {
+		query := url.Values{}
+		query.Set("code_name", code.Name)
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(maxTaskLimit))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "OAuth "+config.Token)
+		req.Header.Set("Accept", "application/json")
+		var list struct {
+			Tasks []iron.Task `json:"tasks"`
+		}
+		done := ironCall(ctx, "get_tasks", attribute.String("iron.code_name", code.Name))
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&list)
+			_ = resp.Body.Close()
+		}
+		done(err)
+		var ironResp *iron.Response
+		if resp != nil {
+			ironResp = &iron.Response{Response: resp}
+		}
+		if err := ironError(ironResp, err, "tasks"); err != nil {
+			return nil, err
+		}
+		for _, task := range list.Tasks {
+			if task.CodeID == code.ID || task.CodeName == code.Name {
+				tasks = append(tasks, task)
+			}
+		}
+		if len(list.Tasks) < maxTaskLimit {
+			break
+		}
+	}
+	return tasks, nil
+}
+
+func getCode(ctx echo.Context, client *iron.Client) (*iron.Code, error) {
+	codeID := ctx.Param("codeID")
+	done := ironCall(ctx.Request().Context(), "get_code", attribute.String("iron.code_id", codeID))
+	code, resp, err := client.Codes.GetCode(codeID)
+	done(err)
+	if err := ironError(resp, err, "code"); err != nil {
+		return nil, err
+	}
+	if code.ID == "" {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "code not found")
+	}
+	return code, nil
+}
+
+// ironError maps a failed Iron API call to an HTTP error. The client does not
+// treat error statuses as errors, so the response status is checked as well
+func ironError(resp *iron.Response, err error, what string) error {
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "error retrieving "+what).SetInternal(err)
+	}
+	if resp == nil {
+		return nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, what+" not found")
+	case resp.StatusCode >= http.StatusMultipleChoices:
+		return echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("error retrieving %s: Iron returned %d", what, resp.StatusCode))
+	}
+	return nil
+}
+
+func codeInfo(code iron.Code) CodeInfo {
+	return CodeInfo{
+		ID:           code.ID,
+		Name:         code.Name,
+		Image:        code.Image,
+		Revision:     code.Rev,
+		LatestChange: code.LatestChange,
+	}
+}
+
+// DecodeSchedule describes a schedule from its CronPayload
+func DecodeSchedule(schedule iron.Schedule) ScheduleInfo {
+	info := ScheduleInfo{
+		ID:          schedule.ID,
+		Timeout:     schedule.Timeout,
+		Cluster:     schedule.Cluster,
+		Status:      schedule.Status,
+		NextStart:   schedule.NextStart,
+		LastRunTime: schedule.LastRunTime,
+	}
+	var payload siderite.CronPayload
+	if err := json.Unmarshal([]byte(schedule.Payload), &payload); err != nil {
+		info.Error = "unparsable payload"
+		return info
+	}
+	info.Type = payload.Type
+	if info.Type == "" && payload.Schedule != "" {
+		info.Type = ScheduleCron
+	}
+	info.Name = payload.Name
+	info.Expression = payload.Schedule
+	if payload.Timeout > 0 {
+		info.Timeout = payload.Timeout
+	}
+	return info
+}
+
+func createdAt(t TaskInfo) time.Time {
+	if t.CreatedAt == nil {
+		return time.Time{}
+	}
+	return *t.CreatedAt
+}
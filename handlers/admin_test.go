@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAPI(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"codes":[{"id":"21","name":"zeta","image":"zeta:1","rev":3},{"id":"20","name":"testandy","image":"loafoe/siderite:0.1","rev":7}]}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "20"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"20","name":"testandy","image":"loafoe/siderite:0.1","rev":7}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "404"), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"msg":"Code not found"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"schedules":[
+			{"id":"s1","code_name":"testandy","payload":"{\"type\":\"sync\",\"encrypted_payload\":\"secret\",\"timeout\":600}"},
+			{"id":"s2","code_name":"testandy","payload":"{\"schedule\":\"0 * * * *\",\"encrypted_payload\":\"secret\"}"},
+			{"id":"s3","code_name":"testandy","payload":"garbage"},
+			{"id":"s4","code_name":"other","payload":"{\"type\":\"async\"}"}
+		]}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"tasks":[
+			{"id":"t1","code_name":"testandy","status":"complete","created_at":"2023-08-01T10:00:00Z","payload":"secret"},
+			{"id":"t2","code_name":"zeta","status":"running","created_at":"2023-08-01T11:00:00Z"},
+			{"id":"t3","code_id":"20","status":"running","created_at":"2023-08-01T12:00:00Z"}
+		]}`)
+	})
+
+	call := func(handler echo.HandlerFunc, codeID, query string) *httptest.ResponseRecorder {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/admin/codes?"+query, nil), rec)
+		c.SetParamNames("codeID")
+		c.SetParamValues(codeID)
+		if err := handler(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+
+	rec := call(AdminCodes(client), "", "")
+	var codes []CodeInfo
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &codes)) && assert.Len(t, codes, 2) {
+		assert.Equal(t, CodeInfo{ID: "20", Name: "testandy", Image: "loafoe/siderite:0.1", Revision: 7}, codes[0])
+	}
+
+	rec = call(AdminCode(client), "20", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+	var detail CodeDetail
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail)) && assert.Len(t, detail.Schedules, 3) {
+		assert.Equal(t, "testandy", detail.Name)
+		assert.Equal(t, ScheduleSync, detail.Schedules[0].Type)
+		assert.Equal(t, 600, detail.Schedules[0].Timeout)
+		assert.Equal(t, ScheduleCron, detail.Schedules[1].Type)
+		assert.Equal(t, "0 * * * *", detail.Schedules[1].Expression)
+		assert.Equal(t, "unparsable payload", detail.Schedules[2].Error)
+	}
+	assert.Equal(t, http.StatusNotFound, call(AdminCode(client), "404", "").Code)
+
+	rec = call(AdminTasks(client, ironConfig), "20", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+	var tasks []TaskInfo
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tasks)) && assert.Len(t, tasks, 2) {
+		assert.Equal(t, "t3", tasks[0].ID, "newest first")
+		assert.Equal(t, "t1", tasks[1].ID)
+	}
+	rec = call(AdminTasks(client, ironConfig), "20", "limit=1")
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tasks))
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, http.StatusBadRequest, call(AdminTasks(client, ironConfig), "20", "limit=0").Code)
+}
+
+func TestAdminTasksPages(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "20"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"20","name":"testandy","image":"loafoe/siderite:0.1","rev":7}`)
+	})
+	// 150 tasks of another code are newer than the tasks of testandy. The code name is
+	// recorded but ignored, so the handler has to page past the other tasks
+	var all []string
+	for i := 0; i < 150; i++ {
+		all = append(all, fmt.Sprintf(`{"id":"z%d","code_name":"zeta","created_at":"2023-08-02T10:00:00Z"}`, i))
+	}
+	for i := 0; i < 5; i++ {
+		all = append(all, fmt.Sprintf(`{"id":"t%d","code_name":"testandy","created_at":"2023-08-01T1%d:00:00Z"}`, i, 5-i))
+	}
+	var codeNames []string
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "OAuth "+token, r.Header.Get("Authorization"))
+		codeNames = append(codeNames, r.URL.Query().Get("code_name"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		start, end := min(page*perPage, len(all)), min((page+1)*perPage, len(all))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"tasks":[`+strings.Join(all[start:end], ",")+`]}`)
+	})
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/admin/codes/20/tasks?limit=3", nil), rec)
+	c.SetParamNames("codeID")
+	c.SetParamValues("20")
+	assert.NoError(t, AdminTasks(client, ironConfig)(c))
+	var tasks []TaskInfo
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tasks)) && assert.Len(t, tasks, 3) {
+		assert.Equal(t, "t0", tasks[0].ID)
+		assert.Equal(t, "t2", tasks[2].ID)
+	}
+	assert.Equal(t, []string{"testandy", "testandy"}, codeNames, "tasks are listed by code name until enough are found")
+}
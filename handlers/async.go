@@ -1,82 +1,145 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/tracing"
 	siderite "github.com/philips-labs/siderite/models"
 	"github.com/philips-software/go-hsdp-api/iron"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// AsyncRequest is an asynchronous invocation of a function. The response is posted to CallbackURL by the function
+type AsyncRequest struct {
+	CodeID      string
+	Path        string
+	CallbackURL string
+	Header      http.Header
+	Body        []byte
+}
+
 func Async(rt *IronBackendRoundTripper) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
+	return func(ctx echo.Context) (err error) {
+		codeID := ctx.Param("codeID")
+		start := time.Now()
+		event := audit.Request(ctx, audit.EventInvoke)
+		event.Principal = mw.GetPrincipal(ctx).String()
+		event.Backend = rt.Name
+		event.CodeID = codeID
+		event.Mode = "async"
+		defer func() {
+			event.Done(start, err)
+			audit.FromContext(ctx.Request().Context()).Log(event)
+		}()
+
 		callbackURL := ctx.Request().Header.Get("X-Callback-URL")
 		if callbackURL == "" {
 			return fmt.Errorf("missing X-Callback-URL header")
 		}
-		codeID := ctx.Param("codeID")
-		path := ctx.Param("*")
-		code, _, err := rt.Client.Codes.GetCode(codeID)
-		if err != nil {
-			return fmt.Errorf("error retrieving code: %w", err)
-		}
-		schedules, _, err := rt.Client.Schedules.GetSchedulesWithCode(code.Name)
-		if err != nil {
-			return fmt.Errorf("error retrieving schedule: %w", err)
-		}
-		fmt.Printf("found %d matching schedule(s)\n", len(*schedules))
-
-		var schedule *iron.Schedule
-		var cfg siderite.CronPayload
-		for _, s := range *schedules {
-			_ = json.Unmarshal([]byte(s.Payload), &cfg)
-			if cfg.Type == "async" {
-				schedule = &s
-				break
-			}
-		}
-		if schedule == nil {
-			return fmt.Errorf("cannot async locate schedule for codeID: %s", codeID)
-		}
-		fmt.Printf("creating async task from schedule %s\n", schedule.ID)
-		cacheRequest := request{
-			Callback: callbackURL,
-			Path:     path,
-		}
-		headers := make(map[string]string)
-		for k, v := range ctx.Request().Header {
-			headers[k] = v[0]
+		r := AsyncRequest{
+			CodeID:      codeID,
+			Path:        ctx.Param("*"),
+			CallbackURL: callbackURL,
+			Header:      ctx.Request().Header,
 		}
 		if ctx.Request().Body != nil {
-			data, err := ioutil.ReadAll(ctx.Request().Body)
+			r.Body, err = io.ReadAll(ctx.Request().Body)
 			if err != nil {
 				return fmt.Errorf("error reading body: %w", err)
 			}
-			cacheRequest.Body = string(data)
-		}
-		jsonData, err := json.Marshal(&cacheRequest)
-		if err != nil {
-			return fmt.Errorf("error JSON encoding data: %w", err)
 		}
-		timeout := schedule.Timeout
-		if timeout < 60 {
-			timeout = backendKeepRunning
-		}
-		task, _, err := rt.Client.Tasks.QueueTask(iron.Task{
-			CodeName: schedule.CodeName,
-			Payload:  cfg.EncryptedPayload,
-			Cluster:  schedule.Cluster,
-			Timeout:  timeout,
-		})
+		taskID, err := rt.QueueAsync(ctx.Request().Context(), r, &event)
 		if err != nil {
-			return fmt.Errorf("failed to spawn task: %w", err)
+			return err
 		}
-		rt.Cache.Set(task.ID, jsonData, cache.DefaultExpiration)
+		event.Status = http.StatusAccepted
+
+		return ctx.JSONBlob(http.StatusAccepted, []byte(fmt.Sprintf("{\"taskID\":\"%s\"}\n", taskID)))
+	}
+}
+
+// QueueAsync queues a task from the async schedule of the code. The request is cached
+// until the task collects it as its payload. event, when not nil, records the code and task
+func (rt *IronBackendRoundTripper) QueueAsync(ctx context.Context, r AsyncRequest, event *audit.Event) (string, error) {
+	if event == nil {
+		event = &audit.Event{}
+	}
+	done := ironCall(ctx, "get_code", attribute.String("iron.code_id", r.CodeID))
+	code, _, err := rt.Client.Codes.GetCode(r.CodeID)
+	done(err)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving code: %w", err)
+	}
+	event.CodeName = code.Name
+	done = ironCall(ctx, "get_schedules", attribute.String("iron.code_name", code.Name))
+	schedules, _, err := rt.Client.Schedules.GetSchedulesWithCode(code.Name)
+	done(err)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving schedule: %w", err)
+	}
+	log := logging.FromContext(ctx).With("code_id", r.CodeID)
+	log.Debug("found matching schedules", "count", len(*schedules))
 
-		return ctx.JSONBlob(http.StatusAccepted, []byte(fmt.Sprintf("{\"taskID\":\"%s\"}\n", task.ID)))
+	var schedule *iron.Schedule
+	var cfg siderite.CronPayload
+	for _, s := range *schedules {
+		_ = json.Unmarshal([]byte(s.Payload), &cfg)
+		if cfg.Type == ScheduleAsync {
+			schedule = &s
+			break
+		}
+	}
+	if schedule == nil {
+		return "", fmt.Errorf("cannot async locate schedule for codeID: %s", r.CodeID)
+	}
+	log.Debug("creating async task from schedule", "schedule_id", schedule.ID)
+	cacheRequest := request{
+		Callback: r.CallbackURL,
+		Path:     r.Path,
+		Body:     string(r.Body),
+		Headers:  make(map[string]string),
+	}
+	// The worker continues the trace of the gateway through the payload headers
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	tracing.Inject(ctx, header)
+	for k, v := range header {
+		cacheRequest.Headers[k] = v[0]
+	}
+	jsonData, err := json.Marshal(&cacheRequest)
+	if err != nil {
+		return "", fmt.Errorf("error JSON encoding data: %w", err)
+	}
+	timeout := schedule.Timeout
+	if timeout < 60 {
+		timeout = backendKeepRunning
+	}
+	task, err := rt.queueTask(ctx, *schedule, cfg.EncryptedPayload, iron.Task{
+		CodeName: schedule.CodeName,
+		Timeout:  timeout,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to spawn task: %w", err)
 	}
+	metrics.TasksQueued.WithLabelValues("async").Inc()
+	metrics.ClusterTasks.WithLabelValues(task.Cluster, "async").Inc()
+	rt.Cache.Set(task.ID, jsonData, cache.DefaultExpiration)
+	rt.own(task.ID)
+	event.TaskID = task.ID
+	event.Cluster = task.Cluster
+	log.Info("queued async task", "task_id", task.ID, "cluster", task.Cluster)
+	return task.ID, nil
 }
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+)
+
+// CronEntries lists the active crontab entries
+func CronEntries(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, ct.Entries())
+	}
+}
+
+// CronStatus returns the crontab status including invalid schedules
+func CronStatus(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, ct.Status())
+	}
+}
+
+// CronHistory returns the run history of a schedule
+func CronHistory(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		history, err := ct.History(ctx.Param("scheduleID"))
+		if err != nil {
+			return cronError(err)
+		}
+		return ctx.JSON(http.StatusOK, history)
+	}
+}
+
+// CronRun triggers a schedule immediately
+func CronRun(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		taskID, err := ct.Run(ctx.Param("scheduleID"))
+		if err != nil {
+			return cronError(err)
+		}
+		return ctx.JSON(http.StatusAccepted, map[string]string{"taskID": taskID})
+	}
+}
+
+// CronPause pauses a schedule
+func CronPause(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if err := ct.Pause(ctx.Param("scheduleID")); err != nil {
+			return cronError(err)
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+// CronResume resumes a paused schedule
+func CronResume(ct *crontab.Crontab) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if err := ct.Resume(ctx.Param("scheduleID")); err != nil {
+			return cronError(err)
+		}
+		return ctx.NoContent(http.StatusNoContent)
+	}
+}
+
+func cronError(err error) error {
+	if errors.Is(err, crontab.ErrScheduleNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return err
+}
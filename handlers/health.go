@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// readinessTimeout bounds the time all readiness checks may take together
+const readinessTimeout = 5 * time.Second
+
+// ReadinessCheck is a dependency which must be available before the gateway accepts traffic
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+	// Optional checks are reported but do not fail readiness, e.g. one of several backends
+	Optional bool
+}
+
+// Readiness is the result of the readiness checks, keyed by check name
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Healthz reports the process is alive
+func Healthz() echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// Readyz runs the checks concurrently and responds 503 when any required check fails.
+// Failing optional checks report the gateway as degraded
+func Readyz(checks ...ReadinessCheck) echo.HandlerFunc {
+	optional := make(map[string]bool)
+	for _, check := range checks {
+		optional[check.Name] = check.Optional
+	}
+	return func(ctx echo.Context) error {
+		checkCtx, cancel := context.WithTimeout(ctx.Request().Context(), readinessTimeout)
+		defer cancel()
+
+		readiness := Readiness{Status: "ready", Checks: make(map[string]string)}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, check := range checks {
+			wg.Add(1)
+			go func(check ReadinessCheck) {
+				defer wg.Done()
+				result := "ok"
+				if err := check.Check(checkCtx); err != nil {
+					result = err.Error()
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				readiness.Checks[check.Name] = result
+			}(check)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		for name, result := range readiness.Checks {
+			switch {
+			case result == "ok":
+			case optional[name]:
+				if status == http.StatusOK {
+					readiness.Status = "degraded"
+				}
+			default:
+				readiness.Status = "not ready"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		return ctx.JSON(status, readiness)
+	}
+}
+
+// IronCheck checks the Iron API is reachable with the project credentials. A result
+// is reused for interval, so frequent probes do not hammer the Iron API
+func IronCheck(client *iron.Client, interval time.Duration) ReadinessCheck {
+	var mu sync.Mutex
+	var checked time.Time
+	var last error
+	return ReadinessCheck{
+		Name: "iron",
+		Check: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !checked.IsZero() && time.Since(checked) < interval {
+				return last
+			}
+			done := ironCall(ctx, "get_codes")
+			_, resp, err := client.Codes.GetCodes()
+			if err != nil {
+				err = fmt.Errorf("iron API unreachable: %w", err)
+			} else if resp != nil && resp.StatusCode >= http.StatusMultipleChoices {
+				// e.g. 401 with invalid project credentials
+				err = fmt.Errorf("iron API returned %s", resp.Status)
+			}
+			done(err)
+			checked, last = time.Now(), err
+			return last
+		},
+	}
+}
+
+// BootstrapCheck checks the ferrite bootstrap provided a project and cluster
+func BootstrapCheck(config *iron.Config) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "ferrite_bootstrap",
+		Check: func(ctx context.Context) error {
+			if config.ProjectID == "" || len(config.ClusterInfo) == 0 || config.ClusterInfo[0].ClusterID == "" {
+				return fmt.Errorf("ferrite bootstrap incomplete")
+			}
+			return nil
+		},
+	}
+}
+
+// CrontabCheck checks the crontab is running
+func CrontabCheck(ct *crontab.Crontab) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "crontab",
+		Check: func(ctx context.Context) error {
+			if !ct.Running() {
+				return fmt.Errorf("crontab not running")
+			}
+			return nil
+		},
+	}
+}
+
+// TunnelCheck checks the tunnel server, through which workers connect, accepts connections on addr
+func TunnelCheck(addr string) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "tunnel",
+		Check: func(ctx context.Context) error {
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return fmt.Errorf("tunnel listener %s down: %w", addr, err)
+			}
+			return conn.Close()
+		},
+	}
+}
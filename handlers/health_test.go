@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-software/go-hsdp-api/iron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	calls := 0
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes"), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"codes":[{"id":"20","name":"testandy"}]}`)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tunnel := listener.Addr().String()
+
+	probe := func(checks ...ReadinessCheck) (int, Readiness) {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+		assert.NoError(t, Readyz(checks...)(c))
+		var readiness Readiness
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &readiness))
+		return rec.Code, readiness
+	}
+
+	ironCheck := IronCheck(client, time.Minute)
+	code, readiness := probe(ironCheck, TunnelCheck(tunnel), BootstrapCheck(&iron.Config{ProjectID: projectID, ClusterInfo: []iron.ClusterInfo{{ClusterID: "c1"}}}))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", readiness.Status)
+	assert.Equal(t, map[string]string{"iron": "ok", "tunnel": "ok", "ferrite_bootstrap": "ok"}, readiness.Checks)
+
+	_, _ = probe(ironCheck)
+	assert.Equal(t, 1, calls, "iron results are reused within the interval")
+
+	assert.NoError(t, listener.Close())
+	code, readiness = probe(TunnelCheck(tunnel), CrontabCheck(crontab.New(client, crontab.Config{})), ReadinessCheck{
+		Name:  "failing",
+		Check: func(ctx context.Context) error { return errors.New("boom") },
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", readiness.Status)
+	assert.Contains(t, readiness.Checks["tunnel"], "tunnel listener")
+	assert.Equal(t, "crontab not running", readiness.Checks["crontab"])
+	assert.Equal(t, "boom", readiness.Checks["failing"])
+
+	// Credentials rejected by Iron fail the check
+	muxIRON.HandleFunc(client.Path("projects", "other", "codes"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"msg":"Invalid project/token combination"}`)
+	})
+	rejected, err := iron.NewClient(&iron.Config{BaseURL: serverIRON.URL, ProjectID: "other", Token: "wrong"})
+	if assert.NoError(t, err) {
+		code, readiness = probe(IronCheck(rejected, time.Minute))
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "iron API returned 401 Unauthorized", readiness.Checks["iron"])
+	}
+
+	// Failing optional checks degrade the gateway without taking it out of service
+	code, readiness = probe(ironCheck, ReadinessCheck{
+		Name:     "iron:team-b",
+		Optional: true,
+		Check:    func(ctx context.Context) error { return errors.New("unreachable") },
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "degraded", readiness.Status)
+	assert.Equal(t, map[string]string{"iron": "ok", "iron:team-b": "unreachable"}, readiness.Checks)
+}
+
+func TestDebugStatus(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"codes":[{"id":"20","name":"testandy"},{"id":"21","name":"other"}]}`)
+	})
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	transport.own("task1")
+	handler := DebugStatus(StatusConfig{
+		Backend:   "iron",
+		Config:    &iron.Config{ProjectID: projectID, ClusterInfo: []iron.ClusterInfo{{ClusterID: "c1", Pubkey: "secret"}}},
+		Transport: transport,
+		Crontab:   crontab.New(client, crontab.Config{}),
+		Resolver:  policy.NewResolver(client, &policy.Store{}),
+		StartedAt: time.Now(),
+		IntrospectStats: func() mw.CacheStats {
+			return mw.CacheStats{Hits: 3, Misses: 1, Size: 1}
+		},
+	})
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(httptest.NewRequest(http.MethodGet, "/debug/status", nil), rec)))
+	assert.NotContains(t, rec.Body.String(), "secret")
+	var status Status
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status)) {
+		assert.Equal(t, "iron", status.Backend)
+		assert.Equal(t, []string{"c1"}, status.Clusters)
+		assert.Equal(t, 2, status.Codes)
+		assert.Equal(t, []string{"task1"}, status.InFlightTasks)
+		assert.Equal(t, 0, status.Caches["payloads"])
+		assert.Equal(t, 1, status.Caches["iam_introspect"])
+		assert.Equal(t, 3, status.Caches["iam_introspect_hits"])
+		assert.False(t, status.Cron.Running)
+	}
+}
@@ -1,27 +1,52 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	"github.com/philips-labs/hsdp-funcion-gateway/clusters"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/tracing"
 	siderite "github.com/philips-labs/siderite/models"
 	"github.com/philips-software/go-hsdp-api/iron"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
 	backendKeepRunning = 7200
 )
 
+// workerConnectTimeout is how long a sync request waits for its worker to connect
+var workerConnectTimeout = time.Minute
+
+// taskCancelTimeout bounds cancelling the owned tasks on shutdown
+const taskCancelTimeout = 10 * time.Second
+
 type IronBackendRoundTripper struct {
 	*iron.Client
 	*cache.Cache
 	next http.RoundTripper
 	host string
+	// Clusters selects the cluster of each task. Tasks run on the cluster of their schedule when nil
+	Clusters *clusters.Selector
+	// Name is the backend in the path of namespaced routes, /function/{name}/{codeID}. Empty for the default routes
+	Name string
+
+	mu    sync.Mutex
+	owned map[string]bool
 }
 
 func NewIronBackendRoundTripper(next http.RoundTripper, client *iron.Client, host string) *IronBackendRoundTripper {
@@ -34,9 +59,88 @@ func NewIronBackendRoundTripper(next http.RoundTripper, client *iron.Client, hos
 		Client: client,
 		host:   host,
 		Cache:  cache.New(20*time.Minute, 40*time.Minute),
+		owned:  make(map[string]bool),
+	}
+}
+
+// own registers a task the gateway is responsible for cancelling on shutdown
+func (rt *IronBackendRoundTripper) own(taskID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.owned[taskID] = true
+}
+
+func (rt *IronBackendRoundTripper) release(taskID string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.owned, taskID)
+}
+
+// OwnedTasks returns the IDs of the in-flight tasks owned by the gateway
+func (rt *IronBackendRoundTripper) OwnedTasks() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	taskIDs := make([]string, 0, len(rt.owned))
+	for taskID := range rt.owned {
+		taskIDs = append(taskIDs, taskID)
+	}
+	sort.Strings(taskIDs)
+	return taskIDs
+}
+
+// Shutdown cancels the tasks still owned by the gateway. These are sync tasks
+// which are still handling a request and async tasks which did not collect
+// their payload yet, as the payload cache does not survive a restart. Cancelling
+// gets its own budget of taskCancelTimeout, so tasks are cancelled even when
+// draining requests used up ctx
+func (rt *IronBackendRoundTripper) Shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), taskCancelTimeout)
+	defer cancel()
+	for _, taskID := range rt.OwnedTasks() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		slog.Info("cancelling owned task", "task_id", taskID)
+		if err := rt.cancelTask(ctx, taskID, "shutdown"); err != nil {
+			slog.Error("error cancelling task", "task_id", taskID, "error", err)
+			continue
+		}
+		rt.release(taskID)
+	}
+	return nil
+}
+
+// ironCall starts the span of an Iron API call. The returned func ends it and records the call metrics
+func ironCall(ctx context.Context, operation string, attributes ...attribute.KeyValue) func(error) {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "iron."+operation, attributes...)
+	return func(err error) {
+		metrics.ObserveIron(operation, start, err)
+		tracing.End(span, err)
 	}
 }
 
+// queueTask queues a task of schedule on the cluster chosen by the cluster selector
+func (rt *IronBackendRoundTripper) queueTask(ctx context.Context, schedule iron.Schedule, encryptedPayload string, task iron.Task) (*iron.Task, error) {
+	return rt.Clusters.Queue(schedule, encryptedPayload, task, func(task iron.Task) (*iron.Task, *iron.Response, error) {
+		done := ironCall(ctx, "queue_task", attribute.String("iron.code_name", task.CodeName), attribute.String("iron.cluster", task.Cluster))
+		queued, resp, err := rt.Client.Tasks.QueueTask(task)
+		done(err)
+		return queued, resp, err
+	})
+}
+
+// cancelTask cancels a task owned by the gateway, reason labels the cancellation in the metrics
+func (rt *IronBackendRoundTripper) cancelTask(ctx context.Context, taskID, reason string) error {
+	done := ironCall(ctx, "cancel_task", attribute.String("iron.task_id", taskID))
+	_, _, err := rt.Client.Tasks.CancelTask(taskID)
+	done(err)
+	if err == nil {
+		metrics.TasksCancelled.WithLabelValues(reason).Inc()
+	}
+	return err
+}
+
 func waitForPort(timeout time.Duration, host string) (bool, error) {
 	if timeout == 0 {
 		timeout = time.Duration(1) * time.Minute
@@ -59,8 +163,11 @@ func waitForPort(timeout time.Duration, host string) (bool, error) {
 func (rt *IronBackendRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	var upstreamRequestURI string
 	parts := strings.Split(req.RequestURI, "/")
+	if rt.Name != "" && len(parts) > 2 && parts[2] == rt.Name {
+		parts = append(parts[:2], parts[3:]...)
+	}
 	if len(parts) < 3 || !(parts[1] == "function") { // TODO: remove prefix dependency
-		fmt.Printf("expected /function/{id}/..., got %s\n", req.RequestURI)
+		logging.FromContext(req.Context()).Warn("expected /function/{id}/...", "request_uri", req.RequestURI)
 		return resp, fmt.Errorf("invalid request: %s", req.RequestURI)
 	}
 	if len(parts) > 3 {
@@ -69,75 +176,123 @@ func (rt *IronBackendRoundTripper) RoundTrip(req *http.Request) (resp *http.Resp
 		upstreamRequestURI = "/"
 	}
 	codeID := parts[2]
-	path := parts[1]
-	fmt.Printf("task from codeID [%s] calling handler for [%s] with requestURI [%s]\n", codeID, path, upstreamRequestURI)
-	return rt.handleRequest(codeID, upstreamRequestURI, req)
+	logging.FromContext(req.Context()).Debug("handling sync request", "code_id", codeID, "upstream_uri", upstreamRequestURI)
+	start := time.Now()
+	event := audit.Event{
+		Type:      audit.EventInvoke,
+		RequestID: req.Header.Get(echo.HeaderXRequestID),
+		Principal: mw.PrincipalFromContext(req.Context()).String(),
+		RemoteIP:  req.RemoteAddr,
+		Method:    req.Method,
+		Path:      audit.RedactURL(req.URL),
+		Backend:   rt.Name,
+		CodeID:    codeID,
+		Mode:      "sync",
+	}
+	resp, err = rt.handleRequest(codeID, upstreamRequestURI, req, &event)
+	if resp != nil {
+		event.Status = resp.StatusCode
+	}
+	event.Done(start, err)
+	audit.FromContext(req.Context()).Log(event)
+	return resp, err
 }
 
-func (rt *IronBackendRoundTripper) handleRequest(codeID, upstreamRequestURI string, req *http.Request) (resp *http.Response, err error) {
+func (rt *IronBackendRoundTripper) handleRequest(codeID, upstreamRequestURI string, req *http.Request, event *audit.Event) (resp *http.Response, err error) {
+	ctx := req.Context()
+	log := logging.FromContext(ctx).With("code_id", codeID)
+	done := ironCall(ctx, "get_code", attribute.String("iron.code_id", codeID))
 	code, _, err := rt.Client.Codes.GetCode(codeID)
+	done(err)
 	if err != nil {
-		fmt.Printf("error retrieving code: %v\n", err)
+		log.Error("error retrieving code", "error", err)
 		return resp, err
 	}
+	event.CodeName = code.Name
+	done = ironCall(ctx, "get_schedules", attribute.String("iron.code_name", code.Name))
 	schedules, _, err := rt.Client.Schedules.GetSchedulesWithCode(code.Name)
+	done(err)
 	if err != nil {
-		fmt.Printf("error retrieving schedule: %v\n", err)
+		log.Error("error retrieving schedule", "error", err)
 		return resp, err
 	}
-	fmt.Printf("found %d matching schedule(s)\n", len(*schedules))
+	log.Debug("found matching schedules", "count", len(*schedules))
 	var schedule *iron.Schedule
 	var cfg siderite.CronPayload
 	for _, s := range *schedules {
 		_ = json.Unmarshal([]byte(s.Payload), &cfg)
-		if cfg.Type == "sync" {
+		if cfg.Type == ScheduleSync {
 			schedule = &s
 			break
 		}
 	}
 	if schedule == nil {
-		fmt.Printf("cannot locate sync schedule for codeID: %s\n", codeID)
+		log.Warn("cannot locate sync schedule")
 		return resp, fmt.Errorf("cannot locate schedule for codeID: %s", codeID)
 	}
-	fmt.Printf("creating task from schedule %s\n", schedule.CodeName)
+	log.Debug("creating task from schedule", "schedule_id", schedule.ID, "code_name", schedule.CodeName)
 	timeout := schedule.Timeout
 	if timeout < 60 {
 		timeout = backendKeepRunning
 	}
-	task, _, err := rt.Client.Tasks.QueueTask(iron.Task{
+	queued := time.Now()
+	task, err := rt.queueTask(ctx, *schedule, cfg.EncryptedPayload, iron.Task{
 		CodeName: schedule.CodeName,
-		Payload:  cfg.EncryptedPayload,
-		Cluster:  schedule.Cluster,
 		Timeout:  timeout,
 	})
 	if err != nil {
-		fmt.Printf("failed to spawn task: %v\n", err)
+		log.Error("failed to spawn task", "error", err)
 		return resp, err
 	}
-	fmt.Printf("waiting for iron worker to connect..\n")
-	connected, err := waitForPort(time.Duration(1)*time.Minute, rt.host)
+	metrics.TasksQueued.WithLabelValues("sync").Inc()
+	metrics.ClusterTasks.WithLabelValues(task.Cluster, "sync").Inc()
+	rt.own(task.ID)
+	event.TaskID = task.ID
+	event.Cluster = task.Cluster
+	log = log.With("task_id", task.ID, "cluster", task.Cluster)
+	log.Info("waiting for iron worker to connect")
+	_, span := tracing.Start(ctx, "wait_for_port", attribute.String("iron.task_id", task.ID), attribute.String("net.peer.name", rt.host))
+	connected, err := waitForPort(workerConnectTimeout, rt.host)
+	tracing.End(span, err)
 	if err != nil {
-		fmt.Printf("waitForPort %s failed: %v\n", rt.host, err)
+		log.Error("waiting for port failed", "host", rt.host, "error", err)
+		rt.finishTask(ctx, log, task.ID, "unreachable")
 		return resp, fmt.Errorf("waitForPort %s failed: %w", rt.host, err)
 	}
 	if !connected {
-		fmt.Printf("upstream failed to connect in time\n")
+		log.Error("upstream failed to connect in time")
+		rt.finishTask(ctx, log, task.ID, "unreachable")
 		return resp, fmt.Errorf("upstream failed to connect in time")
 	}
+	metrics.ColdStart.WithLabelValues(schedule.CodeName).Observe(time.Since(queued).Seconds())
 	if upstreamRequestURI != "" {
 		req.URL.Path = upstreamRequestURI
 	}
-	fmt.Printf("sending request upstream: %s\n", req.RequestURI)
+	log.Debug("sending request upstream", "path", req.URL.Path)
+	upstreamCtx, span := tracing.Start(ctx, "upstream", attribute.String("iron.task_id", task.ID), attribute.String("http.target", req.URL.Path))
+	tracing.Inject(upstreamCtx, req.Header)
 	resp, err = rt.next.RoundTrip(req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	tracing.End(span, err)
 	// Kill task after single handling. In the future we might keep this around for a while longer
 	if resp != nil {
-		fmt.Printf("response code: %d\n", resp.StatusCode)
+		log.Debug("upstream responded", "status", resp.StatusCode)
 	}
-	fmt.Printf("cancelling task %s..\n", task.ID)
-	_, _, _ = rt.Client.Tasks.CancelTask(task.ID)
+	rt.finishTask(ctx, log, task.ID, "completed")
 	return resp, err
 }
 
+// finishTask cancels a sync task and releases it from the owned tasks
+func (rt *IronBackendRoundTripper) finishTask(ctx context.Context, log *slog.Logger, taskID, reason string) {
+	log.Debug("cancelling task", "reason", reason)
+	if err := rt.cancelTask(ctx, taskID, reason); err != nil {
+		log.Error("error cancelling task", "error", err)
+	}
+	rt.release(taskID)
+}
+
 type request struct {
 	Headers  map[string]string `json:"headers"`
 	Body     string            `json:"body"`
@@ -145,19 +300,23 @@ type request struct {
 	Path     string            `json:"path"`
 }
 
-func (rt *IronBackendRoundTripper) getPayload(taskID string) ([]byte, error) {
-	fmt.Printf("searching cache for task: %s\n", taskID)
+// getPayload returns the cached request of an async task. Payloads are never logged
+func (rt *IronBackendRoundTripper) getPayload(ctx context.Context, taskID string) ([]byte, error) {
+	log := logging.FromContext(ctx).With("task_id", taskID)
 	data, ok := rt.Cache.Get(taskID)
 	if !ok {
-		fmt.Printf("request data for taskID not found: %s\n", taskID)
+		metrics.PayloadCacheRequests.WithLabelValues("miss").Inc()
+		log.Warn("request data for task not found")
 		return nil, fmt.Errorf("request data not found")
 	}
 	requestData, ok := data.([]byte)
 	if !ok {
-		fmt.Printf("cache item was not a byte array\n")
+		log.Error("cache item was not a byte array")
 		return nil, fmt.Errorf("cache item was not a byte array")
 	}
 
-	fmt.Printf("returning payload: %s\n", string(requestData))
+	metrics.PayloadCacheRequests.WithLabelValues("hit").Inc()
+	rt.release(taskID)
+	log.Debug("returning payload", "bytes", len(requestData))
 	return requestData, nil
 }
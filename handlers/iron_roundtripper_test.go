@@ -1,15 +1,22 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
 	"github.com/philips-software/go-hsdp-api/iron"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,6 +27,7 @@ var (
 	muxIRON       *http.ServeMux
 	serverIRON    *httptest.Server
 	client        *iron.Client
+	ironConfig    *iron.Config
 	projectID     = "48a0183d-a588-41c2-9979-737d15e9e860"
 	token         = "YM7eZakYwqoui5znoH4g"
 )
@@ -32,11 +40,12 @@ func setup(t *testing.T) func() {
 
 	var err error
 
-	client, err = iron.NewClient(&iron.Config{
+	ironConfig = &iron.Config{
 		BaseURL:   serverIRON.URL,
 		ProjectID: projectID,
 		Token:     token,
-	})
+	}
+	client, err = iron.NewClient(ironConfig)
 	assert.Nil(t, err)
 	assert.NotNil(t, client)
 
@@ -211,3 +220,279 @@ func TestAsyncHandler(t *testing.T) {
 	err := handler(c)
 	assert.Nil(t, err)
 }
+
+func TestAsyncHandlerAudit(t *testing.T) {
+	var codeID = "20"
+	teardown := setup(t)
+	defer teardown()
+
+	scheduleID := "8GSI27QGIZ5sSYRiMBIoASz8"
+	taskID := "bFp7OMpXdVsvRHp4sVtqb3gV"
+	schedule := `{"id":"` + scheduleID + `","project_id":"` + projectID + `","code_name":"testandy","cluster":"XKaaLazEd1sAUAyZZN8IG6Tg","payload":"{\"type\":\"sync\"}"}`
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"schedules":[`+schedule+`]}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules", scheduleID), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, schedule)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", codeID), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"`+codeID+`","name":"testandy"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"tasks":[{"id":"`+taskID+`"}],"msg":"Queued up"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks", taskID, "cancel"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"msg":"Cancelled"}`)
+	})
+
+	origin, _ := url.Parse(serverBackend.URL)
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, origin.Host)
+	handler := middleware.ProxyWithConfig(middleware.ProxyConfig{
+		Balancer:  middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{{URL: origin}}),
+		Transport: transport,
+	})(func(ctx echo.Context) error {
+		return nil
+	})
+	e := echo.New()
+	invoke := func(target string) (audit.Event, error) {
+		var auditLog bytes.Buffer
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req = req.WithContext(audit.NewContext(req.Context(), audit.New(&auditLog)))
+		assert.Nil(t, handler(e.NewContext(req, httptest.NewRecorder())))
+		var event audit.Event
+		return event, json.Unmarshal(auditLog.Bytes(), &event)
+	}
+
+	event, err := invoke("/function/" + codeID + "/20?secret=xxx")
+	if assert.NoError(t, err) {
+		assert.Equal(t, audit.EventInvoke, event.Type)
+		assert.Equal(t, "sync", event.Mode)
+		assert.Equal(t, codeID, event.CodeID)
+		assert.Equal(t, "testandy", event.CodeName)
+		assert.Equal(t, taskID, event.TaskID)
+		assert.Equal(t, "/function/20/20?secret=REDACTED", event.Path)
+	}
+
+	// The backend name of namespaced routes is not part of the code ID
+	transport.Name = "team-a"
+	event, err = invoke("/function/team-a/" + codeID + "/20")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "team-a", event.Backend)
+		assert.Equal(t, codeID, event.CodeID)
+		assert.Equal(t, "testandy", event.CodeName)
+	}
+}
+
+func TestShutdownCancelsOwnedTasks(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	taskID := "bFp7OMpXdVsvRHp4sVtqb3gV"
+	cancelled := make(map[string]bool)
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks", taskID, "cancel"), func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal(t, "POST", r.Method) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cancelled[taskID] = true
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"msg":"Cancelled"}`)
+	})
+
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	transport.own(taskID)
+	transport.own("collected")
+	transport.Cache.Set("collected", []byte(`{}`), cache.DefaultExpiration)
+	_, err := transport.getPayload(context.Background(), "collected")
+	assert.NoError(t, err)
+
+	assert.NoError(t, transport.Shutdown(context.Background()))
+	assert.True(t, cancelled[taskID])
+	assert.Empty(t, transport.owned)
+}
+
+func TestShutdownAfterDrainTimeout(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	taskID := "bFp7OMpXdVsvRHp4sVtqb3gV"
+	cancelled := make(chan string, 1)
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks", taskID, "cancel"), func(w http.ResponseWriter, r *http.Request) {
+		cancelled <- taskID
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"msg":"Cancelled"}`)
+	})
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	transport.own(taskID)
+
+	// a request which is still running when the shutdown timeout expires
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer func() {
+		close(release)
+		server.Close()
+	}()
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Config.Shutdown(ctx), context.DeadlineExceeded)
+	assert.NoError(t, transport.Shutdown(ctx))
+	select {
+	case id := <-cancelled:
+		assert.Equal(t, taskID, id)
+	default:
+		assert.Fail(t, "owned task was not cancelled after draining overran the timeout")
+	}
+	assert.Empty(t, transport.OwnedTasks())
+}
+
+func TestQueueAsync(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "20"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"20","name":"testandy"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"schedules":[
+			{"id":"s1","code_name":"testandy","payload":"{\"type\":\"sync\"}"},
+			{"id":"s2","code_name":"testandy","cluster":"c1","payload":"{\"type\":\"async\",\"encrypted_payload\":\"xxx\"}"}
+		]}`)
+	})
+	var queued iron.Task
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Tasks []iron.Task `json:"tasks"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		queued = body.Tasks[0]
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"tasks":[{"id":"task1"}],"msg":"Queued up"}`)
+	})
+
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	header := http.Header{}
+	header.Set(echo.HeaderXRequestID, "req-1")
+	var event audit.Event
+	taskID, err := transport.QueueAsync(context.Background(), AsyncRequest{
+		CodeID:      "20",
+		Path:        "hello",
+		CallbackURL: "https://example.com/callback",
+		Header:      header,
+		Body:        []byte(`{"name":"world"}`),
+	}, &event)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "task1", taskID)
+	assert.Equal(t, "task1", event.TaskID)
+	assert.Equal(t, "testandy", event.CodeName)
+	assert.Equal(t, "c1", queued.Cluster)
+	assert.Equal(t, "xxx", queued.Payload)
+
+	data, err := transport.getPayload(context.Background(), taskID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var payload request
+	assert.NoError(t, json.Unmarshal(data, &payload))
+	assert.Equal(t, "https://example.com/callback", payload.Callback)
+	assert.Equal(t, "hello", payload.Path)
+	assert.Equal(t, `{"name":"world"}`, payload.Body)
+	assert.Equal(t, "req-1", payload.Headers[echo.HeaderXRequestID])
+}
+
+func TestPayloadBackends(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	teamA := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	teamA.Name = "team-a"
+	teamB := NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:0")
+	teamB.Name = "team-b"
+	teamB.own("task-b")
+	teamB.Cache.Set("task-b", []byte(`{"body":"b"}`), cache.DefaultExpiration)
+
+	var logged bytes.Buffer
+	e := echo.New()
+	e.Use(audit.Middleware(audit.New(&logged)))
+	e.GET("/payload/:taskID", Payload(teamA, teamB))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/payload/task-b", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"body":"b"}`, rec.Body.String())
+	assert.Empty(t, teamB.OwnedTasks())
+
+	var event audit.Event
+	if assert.NoError(t, json.Unmarshal(logged.Bytes(), &event)) {
+		assert.Equal(t, "team-b", event.Backend)
+		assert.Equal(t, "task-b", event.TaskID)
+	}
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/payload/unknown", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestSyncWorkerUnreachable(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	timeout := workerConnectTimeout
+	workerConnectTimeout = 200 * time.Millisecond
+	defer func() { workerConnectTimeout = timeout }()
+
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "20"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"20","name":"testandy"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"schedules":[{"id":"s1","code_name":"testandy","payload":"{\"type\":\"sync\"}"}]}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"tasks":[{"id":"task1"}],"msg":"Queued up"}`)
+	})
+	cancelled := false
+	muxIRON.HandleFunc(client.Path("projects", projectID, "tasks", "task1", "cancel"), func(w http.ResponseWriter, r *http.Request) {
+		cancelled = true
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"msg":"Cancelled"}`)
+	})
+
+	// Nothing listens on the worker address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	host := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	transport := NewIronBackendRoundTripper(http.DefaultTransport, client, host)
+	req := httptest.NewRequest(http.MethodPost, "/function/20", strings.NewReader(`{}`))
+	_, err = transport.RoundTrip(req)
+	assert.Error(t, err)
+	assert.True(t, cancelled, "the task of an unreachable worker is cancelled")
+	assert.Empty(t, transport.OwnedTasks())
+}
@@ -2,14 +2,36 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
 )
 
-func Payload(rt *IronBackendRoundTripper) echo.HandlerFunc {
+// Payload serves the cached requests of async tasks to their workers. Workers of every
+// backend collect their payload from the same route, so the transport owning the task is used
+func Payload(rts ...*IronBackendRoundTripper) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		taskID := ctx.Param("taskID")
-		data, err := rt.getPayload(taskID)
+		rt := rts[0]
+		for _, candidate := range rts {
+			if _, ok := candidate.Cache.Get(taskID); ok {
+				rt = candidate
+				break
+			}
+		}
+		start := time.Now()
+		event := audit.Request(ctx, audit.EventPayload)
+		event.Principal = mw.GetPrincipal(ctx).String()
+		event.TaskID = taskID
+		event.Backend = rt.Name
+		data, err := rt.getPayload(ctx.Request().Context(), taskID)
+		if err == nil {
+			event.Status = http.StatusOK
+		}
+		event.Done(start, err)
+		audit.FromContext(ctx.Request().Context()).Log(event)
 		if err != nil {
 			return err
 		}
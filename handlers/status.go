@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// StatusConfig holds the components summarised by DebugStatus
+type StatusConfig struct {
+	// Name and Backend are the name and type of the backend
+	Name      string
+	Backend   string
+	Config    *iron.Config
+	Transport *IronBackendRoundTripper
+	Crontab   *crontab.Crontab
+	Resolver  *policy.Resolver
+	StartedAt time.Time
+	// IntrospectStats returns the counters of the IAM introspection cache. Optional
+	IntrospectStats func() mw.CacheStats
+}
+
+// Status summarises the state of the gateway for diagnostics. It holds no secrets
+type Status struct {
+	Name          string         `json:"name,omitempty"`
+	Backend       string         `json:"backend"`
+	ProjectID     string         `json:"project_id"`
+	Clusters      []string       `json:"clusters"`
+	ClusterTasks  map[string]int `json:"cluster_tasks,omitempty"`
+	Codes         int            `json:"codes"`
+	CodesError    string         `json:"codes_error,omitempty"`
+	Cron          crontab.Status `json:"cron"`
+	Caches        map[string]int `json:"caches"`
+	InFlightTasks []string       `json:"in_flight_tasks"`
+	StartedAt     time.Time      `json:"started_at"`
+	Uptime        string         `json:"uptime"`
+}
+
+// DebugStatus returns the Status of the gateway
+func DebugStatus(config StatusConfig) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		status := Status{
+			Name:         config.Name,
+			Backend:      config.Backend,
+			ProjectID:    config.Config.ProjectID,
+			Clusters:     make([]string, 0, len(config.Config.ClusterInfo)),
+			ClusterTasks: config.Transport.Clusters.Served(),
+			Cron:         config.Crontab.Status(),
+			Caches: map[string]int{
+				"payloads": config.Transport.Cache.ItemCount(),
+				"policies": config.Resolver.CacheSize(),
+			},
+			InFlightTasks: config.Transport.OwnedTasks(),
+			StartedAt:     config.StartedAt,
+			Uptime:        time.Since(config.StartedAt).Round(time.Second).String(),
+		}
+		if config.IntrospectStats != nil {
+			stats := config.IntrospectStats()
+			status.Caches["iam_introspect"] = stats.Size
+			status.Caches["iam_introspect_hits"] = int(stats.Hits)
+			status.Caches["iam_introspect_misses"] = int(stats.Misses)
+		}
+		for _, cluster := range config.Config.ClusterInfo {
+			status.Clusters = append(status.Clusters, cluster.ClusterID)
+		}
+		done := ironCall(ctx.Request().Context(), "get_codes")
+		codes, _, err := config.Transport.Client.Codes.GetCodes()
+		done(err)
+		if err != nil {
+			status.CodesError = err.Error()
+		} else {
+			status.Codes = len(*codes)
+		}
+		return ctx.JSON(http.StatusOK, status)
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config configures the gateway log
+type Config struct {
+	// Level is debug, info, warn or error. Defaults to info
+	Level string `json:"level,omitempty" yaml:"level,omitempty"`
+	// Format is text or json. Defaults to text
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+}
+
+// ParseLevel parses a level name, an empty name is info
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// New returns a logger writing to w in the configured format and level
+func New(w io.Writer, config Config) (*slog.Logger, error) {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(config.Format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", config.Format)
+}
+
+type loggerContextKey struct{}
+
+// NewContext returns a context carrying l
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// FromContext returns the request scoped logger of ctx, or the default logger when there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
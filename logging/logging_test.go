@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "warn", Format: "json"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "code_id", "abc")
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "shown", line["msg"])
+	assert.Equal(t, "abc", line["code_id"])
+
+	_, err = New(&buf, Config{Level: "verbose"})
+	assert.Error(t, err)
+	_, err = New(&buf, Config{Format: "xml"})
+	assert.Error(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	e := echo.New()
+	e.Use(Middleware(logger))
+	var requestID string
+	e.GET("/payload/:taskID", func(c echo.Context) error {
+		requestID = RequestID(c)
+		FromContext(c.Request().Context()).Info("handling")
+		return c.NoContent(http.StatusOK)
+	})
+	call := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/payload/1", nil)
+		if requestID != "" {
+			req.Header.Set(echo.HeaderXRequestID, requestID)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := call("abc-123")
+	assert.Equal(t, "abc-123", requestID, "incoming request IDs are propagated")
+	assert.Equal(t, "abc-123", rec.Header().Get(echo.HeaderXRequestID))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		for _, l := range lines {
+			var line map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(l), &line))
+			assert.Equal(t, "abc-123", line["request_id"])
+		}
+		assert.Contains(t, lines[1], `"route":"/payload/:taskID"`)
+	}
+
+	rec = call("")
+	assert.Len(t, requestID, 32, "missing request IDs are generated")
+	assert.Equal(t, requestID, rec.Header().Get(echo.HeaderXRequestID))
+	call(strings.Repeat("x", maxRequestIDLength+1))
+	assert.Len(t, requestID, 32, "oversized request IDs are replaced")
+}
@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxRequestIDLength limits propagated request IDs, longer ones are replaced
+const maxRequestIDLength = 128
+
+// RequestID returns the X-Request-ID of a request, after Middleware assigned it
+func RequestID(c echo.Context) string {
+	return c.Request().Header.Get(echo.HeaderXRequestID)
+}
+
+// Middleware propagates the X-Request-ID of a request or generates one. The ID is returned
+// in the response, forwarded to functions and attached to every line logged for the request
+// through the logger in the request context. Every request is logged when it completes
+func Middleware(l *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			requestID := req.Header.Get(echo.HeaderXRequestID)
+			if requestID == "" || len(requestID) > maxRequestIDLength {
+				requestID = newRequestID()
+				req.Header.Set(echo.HeaderXRequestID, requestID)
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, requestID)
+			logger := l.With("request_id", requestID)
+			c.SetRequest(req.WithContext(NewContext(req.Context(), logger)))
+
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			status := c.Response().Status
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+			logger.Log(req.Context(), level, "request",
+				"method", req.Method,
+				"route", c.Path(),
+				"path", req.URL.Path,
+				"status", status,
+				"remote_ip", c.RealIP(),
+				"latency_ms", time.Since(start).Milliseconds(),
+			)
+			return nil
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
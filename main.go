@@ -1,112 +1,353 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/philips-labs/ferrite/server"
-	"github.com/philips-labs/hsdp-funcion-gateway/crontab"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	"github.com/philips-labs/hsdp-funcion-gateway/config"
 	"github.com/philips-labs/hsdp-funcion-gateway/handlers"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
 	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
-	"github.com/philips-software/go-hsdp-api/iron"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-labs/hsdp-funcion-gateway/ratelimit"
+	"github.com/philips-labs/hsdp-funcion-gateway/tracing"
+)
+
+const (
+	tokenStoreReloadInterval = 10 * time.Second
+	configReloadInterval     = 10 * time.Second
+	readinessCheckInterval   = 10 * time.Second
+)
+
+// Exit codes
+const (
+	exitFailure       = 1
+	exitInvalidConfig = 2
+	exitUsage         = 64
 )
 
 func main() {
-	var config iron.Config
+	os.Exit(run())
+}
+
+func run() int {
+	configFile := flag.String("config", os.Getenv("GATEWAY_CONFIG_FILE"), "configuration file, YAML or JSON")
+	backendName := flag.String("backend", "", "backend of the functions, invoke and cron commands, the default backend when empty")
+	flag.Usage = usage
+	flag.Parse()
+
+	command, args := "serve", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		return serve(*configFile)
+	case "validate-config":
+		return validateConfig(*configFile)
+	case "functions":
+		return functions(*configFile, *backendName, args)
+	case "invoke":
+		return invoke(*configFile, *backendName, args)
+	case "cron":
+		return cronCommand(*configFile, *backendName, args)
+	case "token":
+		return token(args)
+	case "help":
+		flag.Usage()
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+	flag.Usage()
+	return exitUsage
+}
 
-	err := json.Unmarshal([]byte(os.Getenv("IRON_CONFIG")), &config)
+// loadConfig loads the configuration and sets up logging
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.Load(path)
 	if err != nil {
-		fmt.Printf("no iron services found: %v\n", err)
-		return
+		return nil, err
 	}
-	if os.Getenv("BACKEND_TYPE") == "ferrite" { // Need bootstrap
-		bootstrap, err := server.Bootstrap(config.BaseURL, config.Token)
-		if err != nil {
-			fmt.Printf("Error bootstrapping: %v\n", err)
-			return
-		}
-		config.ProjectID = bootstrap.ProjectID
-		config.Project = bootstrap.ProjectID
-		config.ClusterInfo[0].ClusterID = bootstrap.ClusterID
-		config.ClusterInfo[0].Pubkey = bootstrap.PublicKey
-		fmt.Printf("Bootstrapped ferrite config\n")
+	logger, err := logging.New(os.Stdout, cfg.Logging)
+	if err != nil {
+		return nil, err
 	}
+	slog.SetDefault(logger)
+	return cfg, nil
+}
 
-	client, err := iron.NewClient(&config)
+// serve runs the gateway until it receives a shutdown signal
+func serve(configFile string) int {
+	startedAt := time.Now()
+	cfg, err := loadConfig(configFile)
 	if err != nil {
-		fmt.Printf("invalid client: %v\n", err)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		return exitInvalidConfig
 	}
-	codes, _, _ := client.Codes.GetCodes()
-	if codes != nil {
-		for _, c := range *codes {
-			fmt.Printf("code: %s:%s -> %s\n", c.ID, c.Name, c.Image)
+	// Tracing, exported when an OTLP endpoint is configured
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		slog.Error("error setting up tracing", "error", err)
+		return exitFailure
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("error flushing traces", "error", err)
+		}
+	}()
+
+	// Audit log, "stdout" or a file path
+	var auditLog *audit.Logger
+	if cfg.AuditLog != "" {
+		auditLog, err = audit.Open(cfg.AuditLog)
+		if err != nil {
+			slog.Error("error opening audit log", "error", err)
+			return exitFailure
 		}
 	}
+	defer func() {
+		if err := auditLog.Close(); err != nil {
+			slog.Error("error closing audit log", "error", err)
+		}
+	}()
 
 	e := echo.New()
 	e.Use(middleware.Recover())
-	e.Use(middleware.Logger())
+	e.HideBanner = true
+	// Client IPs, which key the rate limits of unauthenticated requests, must not be spoofable
+	trusted, err := cfg.TrustedNetworks()
+	if err != nil {
+		slog.Error("invalid trusted proxies", "error", err)
+		return exitInvalidConfig
+	}
+	e.IPExtractor = newIPExtractor(trusted)
+	e.Use(logging.Middleware(slog.Default()))
+	e.Use(tracing.Middleware())
+	e.Use(mw.Metrics())
+	e.Use(audit.Middleware(auditLog))
 
 	// Authentication
-	authToken := os.Getenv("AUTH_TOKEN_TOKEN")
-	authType := os.Getenv("GATEWAY_AUTH_TYPE")
-	var authMiddleware echo.MiddlewareFunc
-	switch authType {
-	case "none":
-		authMiddleware = mw.NoneAuth()
-	case "iam":
-		cfg := mw.IAMConfig{
-			ClientID:      os.Getenv("AUTH_IAM_CLIENT_ID"),
-			ClientSecret:  os.Getenv("AUTH_IAM_CLIENT_SECRET"),
-			Region:        os.Getenv("AUTH_IAM_REGION"),
-			Environment:   os.Getenv("AUTH_IAM_ENVIRONMENT"),
-			Organizations: strings.Split(os.Getenv("AUTH_IAM_ORGS"), ","),
-			Roles:         strings.Split(os.Getenv("AUTH_IAM_ROLES"), ","),
+	auth, err := newAuthChain(cfg.Auth)
+	if err != nil {
+		slog.Error("error setting up auth", "error", err)
+		return exitFailure
+	}
+	defer auth.Close()
+
+	// Per function access policies
+	policies, err := cfg.PolicyStore()
+	if err != nil {
+		slog.Error("error loading policies", "error", err)
+		return exitInvalidConfig
+	}
+
+	// Per principal rate limits and daily quotas
+	limiter, err := ratelimit.New(cfg.RateLimits)
+	if err != nil {
+		slog.Error("invalid rate limits", "error", err)
+		return exitFailure
+	}
+	limit := ratelimit.Middleware(limiter)
+
+	// Backends, each with its own client, transport and crontab. With a single backend it
+	// must be available, with several ones a failing backend is isolated
+	names := cfg.BackendNames()
+	multiple := len(names) > 1
+	backends := make([]*backend, 0, len(names))
+	var transports []*handlers.IronBackendRoundTripper
+	var resolvers []*policy.Resolver
+	for _, name := range names {
+		be := newBackend(name, cfg.BackendConfigs()[name], cfg, policies, multiple)
+		if be.err != nil {
+			if !multiple {
+				slog.Error("error setting up Iron client", "error", be.err)
+				return exitFailure
+			}
+			slog.Error("backend unavailable", "backend", name, "error", be.err)
+		} else {
+			transports = append(transports, be.transport)
+			resolvers = append(resolvers, be.resolver)
 		}
-		authMiddleware = mw.IAMAuth(cfg)
-	case "token":
-		authMiddleware = mw.TokenAuth(authToken)
-	default:
-		fmt.Printf("invalid authType: %s, falling back to 'token'\n", authType)
-		authMiddleware = mw.TokenAuth(authToken)
-	}
-
-	// Reverse proxy
-	origin, _ := url.Parse("http://localhost:8081/") // Upstream
-	targets := []*middleware.ProxyTarget{
-		{
-			URL: origin,
-		},
-	}
-	balancer := middleware.NewRoundRobinBalancer(targets)
-	transport := handlers.NewIronBackendRoundTripper(http.DefaultTransport, client, "localhost:8081")
-	proxyMiddleware := middleware.ProxyWithConfig(middleware.ProxyConfig{
-		Balancer:  balancer,
-		Transport: transport,
+		backends = append(backends, be)
+	}
+	if len(transports) == 0 {
+		slog.Error("no backend available")
+		return exitFailure
+	}
+	metrics.RegisterPayloadCache(func() int {
+		n := 0
+		for _, transport := range transports {
+			n += transport.Cache.ItemCount()
+		}
+		return n
 	})
 
-	af := e.Group("/async-function", authMiddleware)
-	af.POST("/:codeID/*", handlers.Async(transport))
-	af.POST("/:codeID", handlers.Async(transport))
+	metrics.RegisterIntrospectCache(func() int {
+		return auth.IntrospectStats().Size
+	})
 
-	e.Group("/function", authMiddleware, proxyMiddleware)
-	e.Group("/sync-function", authMiddleware, proxyMiddleware)
+	// Workers of all backends collect their async payload from the same route
+	e.Group("/payload", auth.Tokens(mw.ScopePayloadRead)).GET("/:taskID", handlers.Payload(transports...))
 
-	e.Group("/payload", mw.TokenAuth(authToken)).GET("/:taskID", handlers.Payload(transport))
+	// Prometheus metrics, unauthenticated like the scrape targets of the platform
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
 
-	done, err := crontab.Start(client) // Start crontab
-	if err != nil {
-		fmt.Printf("failed to start cronjob: %v\n", err)
-		return
+	// Routes of each backend under /{route}/{backend}, the default backend also serves the routes without a name
+	defaultName, _ := cfg.DefaultBackendConfig()
+	var checks []handlers.ReadinessCheck
+	for _, be := range backends {
+		status := handlers.StatusConfig{StartedAt: startedAt, IntrospectStats: auth.IntrospectStats}
+		be.routes(e, "/"+be.name, auth, limit, status)
+		if be.name == defaultName {
+			be.routes(e, "", auth, limit, status)
+		}
+		checks = append(checks, be.checks(multiple)...)
 	}
 
-	_ = e.Start(":8079")
-	done <- true
+	// Liveness and readiness probes
+	if cfg.TunnelAddr != "" {
+		checks = append(checks, handlers.TunnelCheck(cfg.TunnelAddr))
+	}
+	e.GET("/healthz", handlers.Healthz())
+	e.GET("/readyz", handlers.Readyz(checks...))
+
+	if cfg.TLS.Addr != "" {
+		tlsConfig, err := newTLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			slog.Error("invalid TLS configuration", "error", err)
+			return exitInvalidConfig
+		}
+		e.TLSServer.Addr = cfg.TLS.Addr
+		e.TLSServer.TLSConfig = tlsConfig
+	}
+
+	for _, be := range backends { // Start crontabs
+		if be.err != nil {
+			continue
+		}
+		if _, err := be.crontab.Start(); err != nil {
+			slog.Error("failed to start crontab", "backend", be.name, "error", err)
+			if !multiple {
+				return exitFailure
+			}
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go newReloader(configFile, cfg, auth, resolvers, limiter).watch(ctx)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(cfg.Listen)
+	}()
+	if cfg.TLS.Addr != "" {
+		go func() {
+			serverErr <- e.StartServer(e.TLSServer)
+		}()
+	}
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("received shutdown signal")
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server error", "error", err)
+			exitCode = exitFailure
+		}
+	}
+	shutdown(cfg.ShutdownTimeout, e, backends, limiter)
+	return exitCode
+}
+
+// shutdown stops accepting new requests and drains in-flight requests within timeout. It
+// then stops the crontab and cancels the tasks owned by the gateway. Both still save the
+// crontab state and cancel the tasks when draining used up the timeout
+func shutdown(timeout time.Duration, e *echo.Echo, backends []*backend, limiter *ratelimit.Limiter) {
+	if timeout <= 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	slog.Info("draining in-flight requests")
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down server", "error", err)
+	}
+	for _, be := range backends {
+		if be.err != nil {
+			continue
+		}
+		slog.Info("stopping crontab", "backend", be.name)
+		if err := be.crontab.Stop(ctx); err != nil {
+			slog.Error("error stopping crontab", "backend", be.name, "error", err)
+		}
+		if err := be.transport.Shutdown(ctx); err != nil {
+			slog.Error("error cancelling owned tasks", "backend", be.name, "error", err)
+		}
+	}
+	if err := limiter.Close(); err != nil {
+		slog.Error("error saving quota state", "error", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+// newIPExtractor returns the client IP extractor. Without trusted proxies the peer address is
+// the client, otherwise X-Forwarded-For is followed back through the trusted proxies only
+func newIPExtractor(trusted []*net.IPNet) echo.IPExtractor {
+	if len(trusted) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, network := range trusted {
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// newTLSConfig returns a server TLS configuration. When a client CA bundle is given,
+// client certificates are requested and verified against it, but only required by CertAuth
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		data, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
 }
@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gateway"
+
+// Registry holds the gateway metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts HTTP requests by route, function and status
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, code ID and status.",
+	}, []string{"route", "code_id", "status"})
+
+	// RequestDuration observes HTTP request latencies by route and function
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latencies by route and code ID.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"route", "code_id"})
+
+	// ColdStart observes the time from queueing a sync task until its worker accepts connections
+	ColdStart = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cold_start_seconds",
+		Help:      "Time from queueing a sync task until the upstream port is ready.",
+		Buckets:   []float64{.5, 1, 2, 5, 10, 20, 30, 45, 60},
+	}, []string{"code_name"})
+
+	// IronDuration observes Iron API call latencies by operation
+	IronDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "iron_api_duration_seconds",
+		Help:      "Iron API call latencies by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// IronErrors counts failed Iron API calls by operation
+	IronErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "iron_api_errors_total",
+		Help:      "Failed Iron API calls by operation.",
+	}, []string{"operation"})
+
+	// TasksQueued counts tasks queued by mode: sync, async or cron
+	TasksQueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_queued_total",
+		Help:      "Iron tasks queued by mode.",
+	}, []string{"mode"})
+
+	// TasksCancelled counts tasks cancelled by the gateway by reason
+	TasksCancelled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_cancelled_total",
+		Help:      "Iron tasks cancelled by the gateway by reason.",
+	}, []string{"reason"})
+
+	// ClusterTasks counts tasks queued by cluster and mode
+	ClusterTasks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cluster_tasks_queued_total",
+		Help:      "Iron tasks queued by cluster and mode.",
+	}, []string{"cluster", "mode"})
+
+	// ClusterFailovers counts failed attempts to queue a task on a cluster after which another cluster was tried
+	ClusterFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cluster_failovers_total",
+		Help:      "Failed task queueing attempts by cluster which failed over to another cluster.",
+	}, []string{"cluster"})
+
+	// PayloadCacheRequests counts async payload lookups by result: hit or miss
+	PayloadCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payload_cache_requests_total",
+		Help:      "Async payload cache lookups by result.",
+	}, []string{"result"})
+
+	// IntrospectCacheRequests counts IAM token introspection cache lookups by result: hit or miss
+	IntrospectCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "iam_introspect_cache_requests_total",
+		Help:      "IAM token introspection cache lookups by result.",
+	}, []string{"result"})
+
+	// CronTriggers counts cron triggers by schedule
+	CronTriggers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_triggers_total",
+		Help:      "Cron triggers by schedule.",
+	}, []string{"schedule_id", "code_name"})
+
+	// CronFailures counts failed cron runs by schedule, both failed triggers and failed tasks
+	CronFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_failures_total",
+		Help:      "Failed cron runs by schedule.",
+	}, []string{"schedule_id", "code_name"})
+
+	// CronRuns counts finished cron runs by schedule and outcome: succeeded or failed
+	CronRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_runs_total",
+		Help:      "Finished cron runs by schedule and outcome.",
+	}, []string{"schedule_id", "outcome"})
+
+	// CronLastSuccess is the time of the last successful run of a schedule
+	CronLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful cron run by schedule.",
+	}, []string{"schedule_id"})
+
+	// CronInvalidSchedules is the number of schedules which could not be added to the crontab, by backend
+	CronInvalidSchedules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_invalid_schedules",
+		Help:      "Schedules with an invalid cron expression or payload by backend.",
+	}, []string{"backend"})
+
+	// CronRefreshFailures counts failed refreshes of the schedules from Iron
+	CronRefreshFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_refresh_failures_total",
+		Help:      "Failed refreshes of the cron schedules.",
+	})
+
+	// AuthFailures counts rejected requests by status: 401, 403 or 503 when IAM failed
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected authentication and authorization attempts by status.",
+	}, []string{"status"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		ColdStart,
+		IronDuration,
+		IronErrors,
+		TasksQueued,
+		TasksCancelled,
+		ClusterTasks,
+		ClusterFailovers,
+		PayloadCacheRequests,
+		IntrospectCacheRequests,
+		CronTriggers,
+		CronFailures,
+		CronRuns,
+		CronLastSuccess,
+		CronInvalidSchedules,
+		CronRefreshFailures,
+		AuthFailures,
+	)
+}
+
+// ObserveIron records the latency and outcome of an Iron API call started at start
+func ObserveIron(operation string, start time.Time, err error) {
+	IronDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		IronErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// RegisterPayloadCache exposes the number of cached async payloads
+func RegisterPayloadCache(size func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "payload_cache_size",
+		Help:      "Async payloads waiting to be collected.",
+	}, func() float64 {
+		return float64(size())
+	}))
+}
+
+// RegisterIntrospectCache exposes the number of cached IAM token introspections
+func RegisterIntrospectCache(size func() int) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "iam_introspect_cache_size",
+		Help:      "Cached IAM token introspection results.",
+	}, func() float64 {
+		return float64(size())
+	}))
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveIron(t *testing.T) {
+	before := testutil.ToFloat64(IronErrors.WithLabelValues("test_op"))
+	ObserveIron("test_op", time.Now(), nil)
+	ObserveIron("test_op", time.Now(), errors.New("boom"))
+	assert.Equal(t, before+1, testutil.ToFloat64(IronErrors.WithLabelValues("test_op")))
+	assert.Equal(t, 1, testutil.CollectAndCount(IronDuration, "gateway_iron_api_duration_seconds"))
+}
+
+func TestHandler(t *testing.T) {
+	RegisterPayloadCache(func() int { return 3 })
+	TasksQueued.WithLabelValues("sync").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(body), "gateway_payload_cache_size 3")
+	assert.Contains(t, string(body), `gateway_tasks_queued_total{mode="sync"}`)
+	assert.Contains(t, string(body), "go_goroutines")
+}
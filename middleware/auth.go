@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+)
+
+// Authenticator authenticates a request and returns its principal. It does
+// not write a response, so authenticators can be combined with AnyOf and AllOf
+type Authenticator func(c echo.Context) (*Principal, error)
+
+// Authentication schemes challenged in WWW-Authenticate headers
+const (
+	SchemeBearer = "Bearer"
+	SchemeToken  = "Token"
+	SchemeSigned = "HmacSHA256"
+)
+
+// Realm is the protection space advertised in authentication challenges
+const Realm = "hsdp-function-gateway"
+
+// Error codes of RFC 6750
+const (
+	ErrorInvalidRequest    = "invalid_request"
+	ErrorInvalidToken      = "invalid_token"
+	ErrorInsufficientScope = "insufficient_scope"
+)
+
+// AuthError is a failed authentication (401) or authorization (403), or an
+// identity provider which could not be reached (503)
+type AuthError struct {
+	Status int
+	// Scheme is the authentication scheme to challenge. No challenge is sent when empty
+	Scheme string
+	// Code is the RFC 6750 error code, empty when no credentials were presented
+	Code    string
+	Message string
+	// Missing is set when the request carries no credentials for the authenticator
+	Missing bool
+	// challenges are the challenges of all chained authenticators
+	challenges []string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+// Challenges returns the WWW-Authenticate header values of the error
+func (e *AuthError) Challenges() []string {
+	if len(e.challenges) > 0 {
+		return e.challenges
+	}
+	if challenge := e.challenge(); challenge != "" {
+		return []string{challenge}
+	}
+	return nil
+}
+
+func (e *AuthError) challenge() string {
+	if e.Scheme == "" {
+		return ""
+	}
+	challenge := fmt.Sprintf("%s realm=%q", e.Scheme, Realm)
+	if e.Code != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", e.Code, e.Message)
+	}
+	return challenge
+}
+
+func unauthorized(scheme, message string) error {
+	return &AuthError{Status: http.StatusUnauthorized, Scheme: scheme, Code: ErrorInvalidToken, Message: message}
+}
+
+func forbidden(scheme, message string) error {
+	return &AuthError{Status: http.StatusForbidden, Scheme: scheme, Code: ErrorInsufficientScope, Message: message}
+}
+
+func unavailable(message string) error {
+	return &AuthError{Status: http.StatusServiceUnavailable, Message: message}
+}
+
+func missingCredentials(scheme, message string) error {
+	return &AuthError{Status: http.StatusUnauthorized, Scheme: scheme, Message: message, Missing: true}
+}
+
+func isMissing(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr) && authErr.Missing
+}
+
+func authStatus(err error) int {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.Status
+	}
+	return http.StatusUnauthorized
+}
+
+// Authenticate returns a middleware which authenticates requests and stores the principal.
+// Failures are returned as *echo.HTTPError, with WWW-Authenticate challenges set on the response
+func Authenticate(authenticator Authenticator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, err := authenticator(c)
+			event := audit.Request(c, audit.EventAuth)
+			event.CodeID = CodeID(c)
+			if err != nil {
+				event.Decision = audit.DecisionDeny
+				event.Status = authStatus(err)
+				event.Reason = err.Error()
+				audit.FromContext(c.Request().Context()).Log(event)
+				metrics.AuthFailures.WithLabelValues(strconv.Itoa(event.Status)).Inc()
+				return authFailure(c, err)
+			}
+			event.Decision = audit.DecisionAllow
+			event.Principal = principal.String()
+			audit.FromContext(c.Request().Context()).Log(event)
+			SetPrincipal(c, principal)
+			return next(c)
+		}
+	}
+}
+
+func authFailure(c echo.Context, err error) error {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		for _, challenge := range authErr.Challenges() {
+			c.Response().Header().Add(echo.HeaderWWWAuthenticate, challenge)
+		}
+	}
+	return echo.NewHTTPError(authStatus(err), err.Error()).SetInternal(err)
+}
+
+// AnyOf tries the authenticators in order and returns the first principal.
+// Authenticators for which the request carries no credentials are skipped
+// when reporting failures, preferring authorization over authentication failures
+func AnyOf(authenticators ...Authenticator) Authenticator {
+	if len(authenticators) == 1 {
+		return authenticators[0]
+	}
+	return func(c echo.Context) (*Principal, error) {
+		var failure error
+		var failures []error
+		for _, authenticate := range authenticators {
+			principal, err := authenticate(c)
+			if err == nil {
+				return principal, nil
+			}
+			failures = append(failures, err)
+			switch {
+			case failure == nil, isMissing(failure) && !isMissing(err):
+				failure = err
+			case authStatus(err) == http.StatusForbidden && authStatus(failure) != http.StatusForbidden:
+				failure = err
+			}
+		}
+		if failure == nil {
+			return nil, missingCredentials("", "no authenticators configured")
+		}
+		return nil, withChallenges(failure, failures)
+	}
+}
+
+// AllOf requires every authenticator to succeed and merges their principals
+func AllOf(authenticators ...Authenticator) Authenticator {
+	if len(authenticators) == 1 {
+		return authenticators[0]
+	}
+	return func(c echo.Context) (*Principal, error) {
+		merged := &Principal{}
+		var types []string
+		for _, authenticate := range authenticators {
+			principal, err := authenticate(c)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, principal.Type)
+			if merged.Name == "" {
+				merged.Name = principal.Name
+			}
+			merged.Organizations = appendUnique(merged.Organizations, principal.Organizations...)
+			merged.Roles = appendUnique(merged.Roles, principal.Roles...)
+			merged.Scopes = appendUnique(merged.Scopes, principal.Scopes...)
+		}
+		merged.Type = strings.Join(types, "+")
+		return merged, nil
+	}
+}
+
+// withChallenges returns failure challenging the schemes of all failures, so clients
+// can pick any of them. The failure itself comes first and carries the error code
+func withChallenges(failure error, failures []error) error {
+	var authErr *AuthError
+	if !errors.As(failure, &authErr) {
+		return failure
+	}
+	combined := *authErr
+	combined.challenges = nil
+	schemes := make(map[string]bool)
+	for _, err := range append([]error{failure}, failures...) {
+		var e *AuthError
+		if !errors.As(err, &e) || e.Scheme == "" || schemes[e.Scheme] {
+			continue
+		}
+		schemes[e.Scheme] = true
+		if err == failure {
+			combined.challenges = append(combined.challenges, e.challenge())
+			continue
+		}
+		combined.challenges = append(combined.challenges, (&AuthError{Scheme: e.Scheme}).challenge())
+	}
+	return &combined
+}
+
+func appendUnique(s []string, values ...string) []string {
+	for _, v := range values {
+		if !contains(s, v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
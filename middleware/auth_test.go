@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthChains(t *testing.T) {
+	store := NewTokenStore()
+	assert.NoError(t, store.Add("batch", "batch-token", ScopeInvokeAsync))
+	tokenAuth := TokenAuthenticator(store, ScopeInvokeAsync)
+	fixed := func(p *Principal) Authenticator {
+		return func(c echo.Context) (*Principal, error) {
+			return p, nil
+		}
+	}
+	browser := fixed(&Principal{Type: "iam", Name: "user", Organizations: []string{"org"}, Roles: []string{"ADMIN"}})
+	denied := func(c echo.Context) (*Principal, error) {
+		return nil, forbidden(SchemeBearer, "access denied")
+	}
+
+	call := func(authenticator Authenticator, authorization string) (int, *Principal) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", nil)
+		if authorization != "" {
+			req.Header.Set(echo.HeaderAuthorization, authorization)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		var principal *Principal
+		if err := Authenticate(authenticator)(func(c echo.Context) error {
+			principal = GetPrincipal(c)
+			return c.String(http.StatusOK, "ok")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code, principal
+	}
+
+	t.Run("any of uses the first matching authenticator", func(t *testing.T) {
+		code, p := call(AnyOf(tokenAuth, browser), "Token batch-token")
+		assert.Equal(t, http.StatusOK, code)
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "token", p.Type)
+			assert.Equal(t, "batch", p.Name)
+		}
+		code, p = call(AnyOf(tokenAuth, browser), "")
+		assert.Equal(t, http.StatusOK, code)
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "iam", p.Type)
+		}
+	})
+
+	t.Run("any of reports the most relevant failure", func(t *testing.T) {
+		code, _ := call(AnyOf(tokenAuth, denied), "")
+		assert.Equal(t, http.StatusForbidden, code)
+		code, _ = call(AnyOf(tokenAuth), "Token wrong")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("all of merges principals", func(t *testing.T) {
+		code, p := call(AllOf(tokenAuth, browser), "Token batch-token")
+		assert.Equal(t, http.StatusOK, code)
+		if assert.NotNil(t, p) {
+			assert.Equal(t, "token+iam", p.Type)
+			assert.Equal(t, "batch", p.Name)
+			assert.Equal(t, []string{"org"}, p.Organizations)
+			assert.Equal(t, []string{ScopeInvokeAsync}, p.Scopes)
+		}
+		code, _ = call(AllOf(tokenAuth, browser), "")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+}
+
+func TestAuthChallenges(t *testing.T) {
+	store := NewTokenStore()
+	assert.NoError(t, store.Add("batch", "batch-token", ScopeInvokeAsync))
+	missingBearer := func(c echo.Context) (*Principal, error) {
+		return nil, missingCredentials(SchemeBearer, "missing bearer token")
+	}
+
+	call := func(authenticator Authenticator, authorization string) *httptest.ResponseRecorder {
+		e := echo.New()
+		e.POST("/foo", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		}, Authenticate(authenticator))
+		req := httptest.NewRequest(http.MethodPost, "/foo", nil)
+		if authorization != "" {
+			req.Header.Set(echo.HeaderAuthorization, authorization)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := call(TokenAuthenticator(store), "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, []string{`Token realm="hsdp-function-gateway"`}, rec.Header().Values(echo.HeaderWWWAuthenticate))
+
+	rec = call(TokenAuthenticator(store), "Token wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, []string{`Token realm="hsdp-function-gateway", error="invalid_token", error_description="invalid token"`},
+		rec.Header().Values(echo.HeaderWWWAuthenticate))
+	assert.Contains(t, rec.Body.String(), "invalid token")
+
+	rec = call(TokenAuthenticator(store, ScopeAdmin), "Token batch-token")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, []string{`Token realm="hsdp-function-gateway", error="insufficient_scope", error_description="insufficient scope"`},
+		rec.Header().Values(echo.HeaderWWWAuthenticate))
+
+	rec = call(AnyOf(missingBearer, TokenAuthenticator(store)), "Token wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, []string{
+		`Token realm="hsdp-function-gateway", error="invalid_token", error_description="invalid token"`,
+		`Bearer realm="hsdp-function-gateway"`,
+	}, rec.Header().Values(echo.HeaderWWWAuthenticate), "all schemes of the chain are challenged")
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"path"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CertConfig configures client certificate authorization. Patterns use
+// path.Match syntax, e.g. "*.svc.example.com". When no patterns are set
+// any certificate verified against the client CA bundle is accepted
+type CertConfig struct {
+	// AllowedSubjects match the subject common name or the full subject DN
+	AllowedSubjects []string `json:"allowed_subjects,omitempty" yaml:"allowed_subjects,omitempty"`
+	// AllowedSANs match DNS, email and URI subject alternative names
+	AllowedSANs []string `json:"allowed_sans,omitempty" yaml:"allowed_sans,omitempty"`
+	Scopes      []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// CertAuth implements mutual TLS client certificate authorization. The
+// certificate chain is verified by the TLS server, see ClientAuth in tls.Config
+func CertAuth(config CertConfig) echo.MiddlewareFunc {
+	return Authenticate(CertAuthenticator(config))
+}
+
+// CertAuthenticator authenticates verified TLS client certificates
+func CertAuthenticator(config CertConfig) Authenticator {
+	return func(c echo.Context) (*Principal, error) {
+		state := c.Request().TLS
+		if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+			return nil, missingCredentials("", "client certificate required")
+		}
+		leaf := state.VerifiedChains[0][0]
+		if !certAllowed(config, leaf) {
+			return nil, forbidden("", "client certificate not allowed")
+		}
+		return certPrincipal(config, leaf), nil
+	}
+}
+
+func certAllowed(config CertConfig, cert *x509.Certificate) bool {
+	if len(config.AllowedSubjects) == 0 && len(config.AllowedSANs) == 0 {
+		return true
+	}
+	if matchAny(config.AllowedSubjects, cert.Subject.CommonName, cert.Subject.String()) {
+		return true
+	}
+	return matchAny(config.AllowedSANs, certSANs(cert)...)
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func certPrincipal(config CertConfig, cert *x509.Certificate) *Principal {
+	name := cert.Subject.CommonName
+	if sans := certSANs(cert); name == "" && len(sans) > 0 {
+		name = sans[0]
+	}
+	return &Principal{
+		Type:          "cert",
+		Name:          name,
+		Organizations: cert.Subject.Organization,
+		Roles:         cert.Subject.OrganizationalUnit,
+		Scopes:        config.Scopes,
+	}
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertAuth(t *testing.T) {
+	handler := CertAuth(CertConfig{
+		AllowedSubjects: []string{"batch-*"},
+		AllowedSANs:     []string{"*.svc.example.com"},
+	})
+	call := func(cert *x509.Certificate) (int, *Principal) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(`{}`))
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code, GetPrincipal(c)
+	}
+
+	code, principal := call(&x509.Certificate{Subject: pkix.Name{CommonName: "batch-nightly", Organization: []string{"org1"}}})
+	assert.Equal(t, http.StatusOK, code)
+	if assert.NotNil(t, principal) {
+		assert.Equal(t, "cert", principal.Type)
+		assert.Equal(t, "batch-nightly", principal.Name)
+		assert.Equal(t, []string{"org1"}, principal.Organizations)
+	}
+	code, _ = call(&x509.Certificate{DNSNames: []string{"reports.svc.example.com"}})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(&x509.Certificate{Subject: pkix.Name{CommonName: "browser"}})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = call(nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CodeID returns the code ID of /async-function/:codeID and of the /function/* proxy routes
+func CodeID(c echo.Context) string {
+	if codeID := c.Param("codeID"); codeID != "" {
+		return codeID
+	}
+	return strings.SplitN(strings.TrimPrefix(c.Param("*"), "/"), "/", 2)[0]
+}
+
+const codeResolvedKey = "code_resolved"
+
+// SetCodeResolved marks the code ID of the request as an existing code, see Metrics
+func SetCodeResolved(c echo.Context) {
+	c.Set(codeResolvedKey, true)
+}
+
+func codeResolved(c echo.Context) bool {
+	resolved, _ := c.Get(codeResolvedKey).(bool)
+	return resolved
+}
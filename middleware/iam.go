@@ -1,70 +1,239 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/patrickmn/go-cache"
 	"github.com/philips-software/go-hsdp-api/iam"
 )
 
+const (
+	// maxOrganizationDepth bounds the walk up the organization hierarchy
+	maxOrganizationDepth = 10
+	organizationCacheTTL = time.Hour
+)
+
+// IAMConfig configures IAM token introspection. A token is allowed when one of its
+// organizations matches Organizations and grants the required roles and permissions
 type IAMConfig struct {
-	Client        *http.Client
-	ClientID      string
-	ClientSecret  string
-	Region        string
-	Environment   string
-	Organizations []string
-	Roles         []string
+	Client       *http.Client `json:"-" yaml:"-"`
+	ClientID     string       `json:"client_id" yaml:"client_id"`
+	ClientSecret string       `json:"client_secret" yaml:"client_secret"`
+	Region       string       `json:"region" yaml:"region"`
+	Environment  string       `json:"environment" yaml:"environment"`
+	// IAMURL and IDMURL override the URLs derived from Region and Environment
+	IAMURL string `json:"iam_url,omitempty" yaml:"iam_url,omitempty"`
+	IDMURL string `json:"idm_url,omitempty" yaml:"idm_url,omitempty"`
+	// Organizations restricts access to these organizations. Empty allows any organization
+	Organizations []string `json:"organizations,omitempty" yaml:"organizations,omitempty"`
+	// IncludeChildOrganizations also allows the descendants of Organizations
+	IncludeChildOrganizations bool        `json:"include_child_organizations,omitempty" yaml:"include_child_organizations,omitempty"`
+	Roles                     Requirement `json:"roles" yaml:"roles"`
+	Permissions               Requirement `json:"permissions" yaml:"permissions"`
+	// Scopes are the OAuth2 scopes of the token
+	Scopes Requirement `json:"scopes" yaml:"scopes"`
+	// Cache caches introspection results. A default cache is used when nil
+	Cache *IntrospectCache `json:"-" yaml:"-"`
+}
+
+// Requirement lists values a token must be granted: at least one of AnyOf and every one of AllOf
+type Requirement struct {
+	AnyOf []string `json:"any_of,omitempty" yaml:"any_of,omitempty"`
+	AllOf []string `json:"all_of,omitempty" yaml:"all_of,omitempty"`
 }
 
+// Satisfied reports whether granted meets the requirement. An empty requirement is always met
+func (r Requirement) Satisfied(granted []string) bool {
+	if len(r.AnyOf) > 0 && !containsAny(r.AnyOf, granted) {
+		return false
+	}
+	for _, value := range r.AllOf {
+		if !contains(granted, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Requirement) String() string {
+	var parts []string
+	if len(r.AnyOf) > 0 {
+		parts = append(parts, "one of "+strings.Join(r.AnyOf, ", "))
+	}
+	if len(r.AllOf) > 0 {
+		parts = append(parts, "all of "+strings.Join(r.AllOf, ", "))
+	}
+	return strings.Join(parts, " and ")
+}
+
+var (
+	errInactiveToken = errors.New("token is not active")
+	errExpiredToken  = errors.New("token has expired")
+)
+
 // IAMAuth implements IAM authorization
 func IAMAuth(config IAMConfig) echo.MiddlewareFunc {
+	authenticator, err := IAMAuthenticator(config)
+	if err != nil {
+		return permanentError(err)
+	}
+	return Authenticate(authenticator)
+}
+
+func newIAMClient(config IAMConfig) (*iam.Client, error) {
 	httpClient := http.DefaultClient
 	if config.Client != nil {
 		httpClient = config.Client
 	}
-	iamClient, err := iam.NewClient(httpClient, &iam.Config{
+	return iam.NewClient(httpClient, &iam.Config{
 		Region:         config.Region,
 		Environment:    config.Environment,
+		IAMURL:         config.IAMURL,
+		IDMURL:         config.IDMURL,
 		OAuth2ClientID: config.ClientID,
 		OAuth2Secret:   config.ClientSecret,
 	})
+}
+
+// CheckIAM verifies IAM is reachable and accepts the client credentials by
+// introspecting a dummy token, which a healthy IAM reports as inactive
+func CheckIAM(config IAMConfig) error {
+	iamClient, err := newIAMClient(config)
 	if err != nil {
-		return permanentError(err)
+		return err
 	}
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			authHeader := c.Request().Header.Get("Authorization")
-			var token string
-			_, _ = fmt.Sscanf(authHeader, "Bearer %s", &token)
-			introspect, _, err := iamClient.WithToken(token).Introspect()
-			if err != nil {
-				_ = c.String(http.StatusUnauthorized, err.Error())
-				return err
+	_, _, err = iamClient.WithToken("gateway-connectivity-check").Introspect()
+	return err
+}
+
+// IAMAuthenticator authenticates IAM bearer tokens using introspection
+func IAMAuthenticator(config IAMConfig) (Authenticator, error) {
+	iamClient, err := newIAMClient(config)
+	if err != nil {
+		return nil, err
+	}
+	introspectCache := config.Cache
+	if introspectCache == nil {
+		introspectCache = NewIntrospectCache(0, 0, 0)
+	}
+	parents := cache.New(organizationCacheTTL, 2*organizationCacheTTL)
+	return func(c echo.Context) (*Principal, error) {
+		authHeader := c.Request().Header.Get("Authorization")
+		var token string
+		_, _ = fmt.Sscanf(authHeader, "Bearer %s", &token)
+		if token == "" {
+			return nil, missingCredentials(SchemeBearer, "missing bearer token")
+		}
+		introspect, err := introspectCache.Introspect(token, func() (*iam.IntrospectResponse, error) {
+			response, _, err := iamClient.WithToken(token).Introspect()
+			return response, err
+		})
+		if errors.Is(err, errInactiveToken) || errors.Is(err, errExpiredToken) {
+			return nil, unauthorized(SchemeBearer, err.Error())
+		}
+		if err != nil {
+			slog.Warn("error introspecting token", "error", err)
+			return nil, unavailable("token introspection failed")
+		}
+		if !config.Scopes.Satisfied(strings.Fields(introspect.Scope)) {
+			return nil, forbidden(SchemeBearer, "requires scopes "+config.Scopes.String())
+		}
+		parentOf := func(orgID string) (string, error) {
+			if parent, ok := parents.Get(orgID); ok {
+				return parent.(string), nil
 			}
-			allowed := false
-			for _, org := range introspect.Organizations.OrganizationList {
-				if allowed {
-					break
-				}
-				if !contains(config.Organizations, org.OrganizationID) {
-					continue
-				}
-				for _, role := range org.Roles {
-					if contains(config.Roles, role) {
-						allowed = true
-						continue
-					}
-				}
+			org, _, err := iamClient.WithToken(token).Organizations.GetOrganizationByID(orgID)
+			if err != nil {
+				return "", err
 			}
-			if !allowed {
-				_ = c.String(http.StatusUnauthorized, "access denied")
-				return fmt.Errorf("access denied")
+			parents.Set(orgID, org.Parent.Value, cache.DefaultExpiration)
+			return org.Parent.Value, nil
+		}
+		if err := iamAllowed(config, introspect, parentOf); err != nil {
+			return nil, err
+		}
+		return iamPrincipal(introspect), nil
+	}, nil
+}
+
+// iamAllowed checks the roles and permissions of the organizations of a token
+// which match the configured organizations
+func iamAllowed(config IAMConfig, introspect *iam.IntrospectResponse, parentOf func(orgID string) (string, error)) error {
+	orgMatched := false
+	for _, org := range introspect.Organizations.OrganizationList {
+		if !organizationAllowed(config, org.OrganizationID, parentOf) {
+			continue
+		}
+		orgMatched = true
+		permissions := appendUnique(append([]string{}, org.Permissions...), org.EffectivePermissions...)
+		if config.Roles.Satisfied(org.Roles) && config.Permissions.Satisfied(permissions) {
+			return nil
+		}
+	}
+	if !orgMatched {
+		return forbidden(SchemeBearer, "access denied: organization not allowed")
+	}
+	var required []string
+	if s := config.Roles.String(); s != "" {
+		required = append(required, "roles "+s)
+	}
+	if s := config.Permissions.String(); s != "" {
+		required = append(required, "permissions "+s)
+	}
+	return forbidden(SchemeBearer, "access denied: requires "+strings.Join(required, " and "))
+}
+
+func organizationAllowed(config IAMConfig, orgID string, parentOf func(orgID string) (string, error)) bool {
+	if len(config.Organizations) == 0 || contains(config.Organizations, orgID) {
+		return true
+	}
+	if !config.IncludeChildOrganizations {
+		return false
+	}
+	for depth := 0; depth < maxOrganizationDepth; depth++ {
+		parent, err := parentOf(orgID)
+		if err != nil {
+			slog.Warn("error looking up parent of organization", "organization", orgID, "error", err)
+			return false
+		}
+		if parent == "" || parent == orgID {
+			return false
+		}
+		if contains(config.Organizations, parent) {
+			return true
+		}
+		orgID = parent
+	}
+	return false
+}
+
+func iamPrincipal(introspect *iam.IntrospectResponse) *Principal {
+	p := &Principal{
+		Type:   "iam",
+		Name:   introspect.Username,
+		Scopes: strings.Fields(introspect.Scope),
+	}
+	if p.Name == "" {
+		p.Name = introspect.ClientID
+	}
+	if p.Name == "" {
+		p.Name = introspect.Sub
+	}
+	for _, org := range introspect.Organizations.OrganizationList {
+		p.Organizations = append(p.Organizations, org.OrganizationID)
+		for _, role := range org.Roles {
+			if !contains(p.Roles, role) {
+				p.Roles = append(p.Roles, role)
 			}
-			return next(c)
 		}
 	}
+	return p
 }
 
 func contains(s []string, e string) bool {
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIAMAuthCachesIntrospection(t *testing.T) {
+	introspections := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/authorize/oauth2/introspect", func(w http.ResponseWriter, r *http.Request) {
+		introspections++
+		_ = r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.Form.Get("token") != "valid" {
+			_, _ = io.WriteString(w, `{"active":false}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{
+  "active": true,
+  "exp": `+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`,
+  "organizations": {
+    "organizationList": [
+      {"organizationId": "org1", "roles": ["ADMIN"]}
+    ]
+  }
+}`)
+	})
+
+	cache := NewIntrospectCache(0, 0, 0)
+	handler := IAMAuth(IAMConfig{
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		IAMURL:        server.URL,
+		IDMURL:        server.URL,
+		Organizations: []string{"org1"},
+		Roles:         Requirement{AnyOf: []string{"ADMIN"}},
+		Cache:         cache,
+	})
+
+	call := func(token string) int {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+
+	hits := testutil.ToFloat64(metrics.IntrospectCacheRequests.WithLabelValues("hit"))
+	assert.Equal(t, http.StatusOK, call("valid"))
+	assert.Equal(t, http.StatusOK, call("valid"))
+	assert.Equal(t, http.StatusUnauthorized, call("invalid"))
+	assert.Equal(t, http.StatusUnauthorized, call("invalid"))
+	assert.Equal(t, 2, introspections)
+
+	stats := cache.Stats()
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.IntrospectCacheRequests.WithLabelValues("hit"))-hits)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 2, stats.Size)
+}
+
+func TestIAMAuthRequirements(t *testing.T) {
+	tokens := map[string]string{
+		"admin":    `{"organizationId": "parent", "roles": ["ADMIN"], "permissions": ["FUNCTION.INVOKE", "FUNCTION.READ"]}`,
+		"reader":   `{"organizationId": "parent", "roles": ["READER"], "permissions": ["FUNCTION.READ"]}`,
+		"child":    `{"organizationId": "child", "roles": ["ADMIN"], "effectivePermissions": ["FUNCTION.INVOKE", "FUNCTION.READ"]}`,
+		"stranger": `{"organizationId": "other", "roles": ["ADMIN"], "permissions": ["FUNCTION.INVOKE", "FUNCTION.READ"]}`,
+	}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/authorize/oauth2/introspect", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		org, ok := tokens[r.Form.Get("token")]
+		if !ok {
+			_, _ = io.WriteString(w, `{"active":false}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{
+  "active": true,
+  "scope": "openid function",
+  "exp": `+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`,
+  "organizations": {"organizationList": [`+org+`]}
+}`)
+	})
+	orgLookups := 0
+	mux.HandleFunc("/authorize/scim/v2/Organizations/", func(w http.ResponseWriter, r *http.Request) {
+		orgLookups++
+		w.Header().Set("Content-Type", "application/json")
+		switch strings.TrimPrefix(r.URL.Path, "/authorize/scim/v2/Organizations/") {
+		case "child":
+			_, _ = io.WriteString(w, `{"id": "child", "parent": {"value": "parent"}}`)
+		case "other":
+			_, _ = io.WriteString(w, `{"id": "other", "parent": {"value": "root"}}`)
+		default:
+			_, _ = io.WriteString(w, `{"id": "root"}`)
+		}
+	})
+
+	call := func(config IAMConfig, token string) int {
+		config.ClientID = "client"
+		config.ClientSecret = "secret"
+		config.IAMURL = server.URL
+		config.IDMURL = server.URL
+		handler := IAMAuth(config)
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+
+	t.Run("empty organizations allow any organization", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(IAMConfig{}, "stranger"))
+		assert.Equal(t, http.StatusUnauthorized, call(IAMConfig{}, "unknown"))
+	})
+
+	t.Run("permissions any of and all of", func(t *testing.T) {
+		anyOf := IAMConfig{Permissions: Requirement{AnyOf: []string{"FUNCTION.INVOKE", "FUNCTION.ADMIN"}}}
+		assert.Equal(t, http.StatusOK, call(anyOf, "admin"))
+		assert.Equal(t, http.StatusForbidden, call(anyOf, "reader"))
+		allOf := IAMConfig{Permissions: Requirement{AllOf: []string{"FUNCTION.INVOKE", "FUNCTION.READ"}}}
+		assert.Equal(t, http.StatusOK, call(allOf, "admin"))
+		assert.Equal(t, http.StatusOK, call(allOf, "child"), "effective permissions count")
+		assert.Equal(t, http.StatusForbidden, call(allOf, "reader"))
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(IAMConfig{Scopes: Requirement{AllOf: []string{"openid", "function"}}}, "reader"))
+		assert.Equal(t, http.StatusForbidden, call(IAMConfig{Scopes: Requirement{AnyOf: []string{"admin"}}}, "reader"))
+	})
+
+	t.Run("child organizations", func(t *testing.T) {
+		config := IAMConfig{Organizations: []string{"parent"}, Roles: Requirement{AnyOf: []string{"ADMIN"}}}
+		assert.Equal(t, http.StatusOK, call(config, "admin"))
+		assert.Equal(t, http.StatusForbidden, call(config, "reader"))
+		assert.Equal(t, http.StatusForbidden, call(config, "child"))
+		assert.Equal(t, 0, orgLookups)
+
+		config.IncludeChildOrganizations = true
+		assert.Equal(t, http.StatusOK, call(config, "child"))
+		assert.Equal(t, http.StatusForbidden, call(config, "stranger"))
+		assert.Equal(t, 3, orgLookups)
+	})
+}
+
+func TestCheckIAM(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/authorize/oauth2/introspect", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"error":"invalid_client"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"active":false}`)
+	})
+
+	config := IAMConfig{ClientID: "client", ClientSecret: "secret", IAMURL: server.URL, IDMURL: server.URL}
+	assert.NoError(t, CheckIAM(config))
+	config.ClientSecret = "wrong"
+	assert.Error(t, CheckIAM(config))
+}
+
+func TestIAMAuthIntrospectionFailure(t *testing.T) {
+	failing := true
+	introspections := 0
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/authorize/oauth2/introspect", func(w http.ResponseWriter, r *http.Request) {
+		introspections++
+		w.Header().Set("Content-Type", "application/json")
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, `{"error":"unavailable"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"active":true,"exp":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`,"organizations":{"organizationList":[{"organizationId":"org1"}]}}`)
+	})
+
+	cache := NewIntrospectCache(0, 0, time.Hour)
+	handler := IAMAuth(IAMConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		IAMURL:       server.URL,
+		IDMURL:       server.URL,
+		Cache:        cache,
+	})
+	call := func() (int, string) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer valid")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code, rec.Header().Get(echo.HeaderWWWAuthenticate)
+	}
+
+	// An IAM outage is not blamed on the token and not cached
+	code, challenge := call()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Empty(t, challenge)
+	assert.Equal(t, 0, cache.Stats().Size)
+
+	failing = false
+	code, _ = call()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, introspections)
+}
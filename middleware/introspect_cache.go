@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/philips-software/go-hsdp-api/iam"
+)
+
+const (
+	defaultIntrospectCacheSize = 10000
+	defaultIntrospectTTL       = 5 * time.Minute
+	defaultNegativeTTL         = 30 * time.Second
+)
+
+// IntrospectCache caches IAM introspection results keyed by a hash of the token.
+// Valid tokens are cached until they expire, capped at the maximum TTL. Inactive and
+// expired tokens are cached for the negative TTL. Failed introspections are not cached
+type IntrospectCache struct {
+	cache       *cache.Cache
+	size        int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	hits        uint64
+	misses      uint64
+}
+
+// CacheStats are the counters of a cache
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+type introspectResult struct {
+	response *iam.IntrospectResponse
+	err      error
+}
+
+// NewIntrospectCache returns a cache holding at most size entries. Zero values select defaults
+func NewIntrospectCache(size int, maxTTL, negativeTTL time.Duration) *IntrospectCache {
+	if size <= 0 {
+		size = defaultIntrospectCacheSize
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultIntrospectTTL
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = defaultNegativeTTL
+	}
+	return &IntrospectCache{
+		cache:       cache.New(maxTTL, 2*maxTTL),
+		size:        size,
+		maxTTL:      maxTTL,
+		negativeTTL: negativeTTL,
+	}
+}
+
+// Stats returns the hit and miss counters and the current number of entries
+func (c *IntrospectCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Size:   c.cache.ItemCount(),
+	}
+}
+
+// Introspect returns the cached introspection result of token or calls introspect and caches the outcome
+func (c *IntrospectCache) Introspect(token string, introspect func() (*iam.IntrospectResponse, error)) (*iam.IntrospectResponse, error) {
+	key := tokenHash(token)
+	if item, ok := c.cache.Get(key); ok {
+		if result, ok := item.(introspectResult); ok {
+			atomic.AddUint64(&c.hits, 1)
+			metrics.IntrospectCacheRequests.WithLabelValues("hit").Inc()
+			return result.response, result.err
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	metrics.IntrospectCacheRequests.WithLabelValues("miss").Inc()
+	response, err := introspect()
+	if err != nil {
+		// IAM failed, the token may well be valid
+		return nil, err
+	}
+	if !response.Active {
+		c.set(key, introspectResult{err: errInactiveToken}, c.negativeTTL)
+		return nil, errInactiveToken
+	}
+	ttl := c.maxTTL
+	if response.Expires > 0 {
+		remaining := time.Until(time.Unix(response.Expires, 0))
+		if remaining <= 0 {
+			c.set(key, introspectResult{err: errExpiredToken}, c.negativeTTL)
+			return nil, errExpiredToken
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+	c.set(key, introspectResult{response: response}, ttl)
+	return response, nil
+}
+
+func (c *IntrospectCache) set(key string, result introspectResult, ttl time.Duration) {
+	if c.cache.ItemCount() >= c.size {
+		c.cache.DeleteExpired()
+		if c.cache.ItemCount() >= c.size {
+			return
+		}
+	}
+	c.cache.Set(key, result, ttl)
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefresh   = 1 * time.Hour
+	minJWKSRefreshOnMiss = 1 * time.Minute
+)
+
+// JWKS holds the public keys of a JSON Web Key Set, loaded from a URL or a file
+// and refreshed periodically. Unknown key IDs trigger a rate limited refresh
+type JWKS struct {
+	url     string
+	file    string
+	client  *http.Client
+	refresh time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	lastAttempt time.Time
+	refreshing  bool
+	// missMu serializes the lookups of unknown key IDs, so concurrent misses fetch once
+	missMu sync.Mutex
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// NewJWKS loads a key set from url or, when url is empty, from file
+func NewJWKS(url, file string, client *http.Client, refresh time.Duration) (*JWKS, error) {
+	if url == "" && file == "" {
+		return nil, fmt.Errorf("either a JWKS URL or file is required")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	jwks := &JWKS{
+		url:     url,
+		file:    file,
+		client:  client,
+		refresh: refresh,
+	}
+	if err := jwks.Refresh(); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+// Refresh reloads the key set
+func (j *JWKS) Refresh() error {
+	j.mu.Lock()
+	j.lastAttempt = time.Now()
+	j.mu.Unlock()
+
+	var data []byte
+	var err error
+	if j.url != "" {
+		data, err = j.fetch()
+	} else {
+		data, err = os.ReadFile(j.file)
+	}
+	if err != nil {
+		return fmt.Errorf("loading JWKS: %w", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+	j.lastRefresh = time.Now()
+	return nil
+}
+
+// Key returns the public key with the given key ID. A stale key set is refreshed
+// in the background while the known keys keep being served
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	stale := time.Since(j.lastRefresh) >= j.refresh
+	retry := time.Since(j.lastAttempt) >= minJWKSRefreshOnMiss
+	if ok && stale && retry && !j.refreshing {
+		j.refreshing = true
+		go j.backgroundRefresh()
+	}
+	j.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	// Misses wait for a refresh in progress, which may provide the key
+	j.missMu.Lock()
+	defer j.missMu.Unlock()
+	j.mu.RLock()
+	key, ok = j.keys[kid]
+	retry = time.Since(j.lastAttempt) >= minJWKSRefreshOnMiss
+	j.mu.RUnlock()
+	if !ok && retry {
+		if err := j.Refresh(); err != nil {
+			slog.Warn("error refreshing JWKS", "url", j.url, "error", err)
+		}
+		j.mu.RLock()
+		key, ok = j.keys[kid]
+		j.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+	return key, nil
+}
+
+func (j *JWKS) backgroundRefresh() {
+	if err := j.Refresh(); err != nil {
+		slog.Warn("error refreshing JWKS", "url", j.url, "error", err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.refreshing = false
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, j.url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skipping JWK", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultOrganizationsClaim = "organizations"
+	defaultRolesClaim         = "roles"
+)
+
+// JWTConfig configures offline validation of IAM issued JWT access tokens
+type JWTConfig struct {
+	Client *http.Client `json:"-" yaml:"-"`
+	// JWKSURL is where the signing keys are fetched from. Takes precedence over JWKSFile
+	JWKSURL  string `json:"jwks_url,omitempty" yaml:"jwks_url,omitempty"`
+	JWKSFile string `json:"jwks_file,omitempty" yaml:"jwks_file,omitempty"`
+	// JWKSRefresh is how often the key set is reloaded. Defaults to 1h
+	JWKSRefresh time.Duration `json:"jwks_refresh,omitempty" yaml:"jwks_refresh,omitempty"`
+	Issuer      string        `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audiences   []string      `json:"audiences,omitempty" yaml:"audiences,omitempty"`
+	// Organizations and Roles restrict access. A token must carry one of each when set
+	Organizations []string `json:"organizations,omitempty" yaml:"organizations,omitempty"`
+	Roles         []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// OrganizationsClaim and RolesClaim name the claims holding organizations and roles
+	OrganizationsClaim string `json:"organizations_claim,omitempty" yaml:"organizations_claim,omitempty"`
+	RolesClaim         string `json:"roles_claim,omitempty" yaml:"roles_claim,omitempty"`
+	// Leeway is the allowed clock skew when checking exp and nbf
+	Leeway time.Duration `json:"leeway,omitempty" yaml:"leeway,omitempty"`
+}
+
+var jwtValidMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWTAuth implements offline JWT access token authorization
+func JWTAuth(config JWTConfig) echo.MiddlewareFunc {
+	authenticator, err := JWTAuthenticator(config)
+	if err != nil {
+		return permanentError(err)
+	}
+	return Authenticate(authenticator)
+}
+
+// JWTAuthenticator validates JWT access tokens offline against a JWKS
+func JWTAuthenticator(config JWTConfig) (Authenticator, error) {
+	jwks, err := NewJWKS(config.JWKSURL, config.JWKSFile, config.Client, config.JWKSRefresh)
+	if err != nil {
+		return nil, err
+	}
+	return JWTAuthenticatorWithKeys(config, jwks), nil
+}
+
+// JWTAuthenticatorWithKeys validates JWT access tokens offline using an existing key set
+func JWTAuthenticatorWithKeys(config JWTConfig, jwks *JWKS) Authenticator {
+	if config.OrganizationsClaim == "" {
+		config.OrganizationsClaim = defaultOrganizationsClaim
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = defaultRolesClaim
+	}
+	parser := &jwt.Parser{
+		ValidMethods:         jwtValidMethods,
+		SkipClaimsValidation: true, // Validated below, honouring Leeway
+	}
+	return func(c echo.Context) (*Principal, error) {
+		authHeader := c.Request().Header.Get("Authorization")
+		var token string
+		_, _ = fmt.Sscanf(authHeader, "Bearer %s", &token)
+		if token == "" {
+			return nil, missingCredentials(SchemeBearer, "missing bearer token")
+		}
+		claims := jwt.MapClaims{}
+		_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return jwks.Key(kid)
+		})
+		if err != nil {
+			return nil, unauthorized(SchemeBearer, err.Error())
+		}
+		if err := validateClaims(config, claims); err != nil {
+			return nil, err
+		}
+		return jwtPrincipal(config, claims), nil
+	}
+}
+
+// validateClaims returns an *AuthError, 403 when the token is valid but lacks organizations or roles
+func validateClaims(config JWTConfig, claims jwt.MapClaims) error {
+	now := time.Now()
+	leeway := int64(config.Leeway / time.Second)
+	if !claims.VerifyExpiresAt(now.Unix()-leeway, true) {
+		return unauthorized(SchemeBearer, "token has expired")
+	}
+	if !claims.VerifyNotBefore(now.Unix()+leeway, false) {
+		return unauthorized(SchemeBearer, "token is not valid yet")
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return unauthorized(SchemeBearer, "invalid issuer")
+	}
+	if len(config.Audiences) > 0 {
+		audiences := claimValues(claims, "aud")
+		found := false
+		for _, aud := range config.Audiences {
+			if contains(audiences, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return unauthorized(SchemeBearer, "invalid audience")
+		}
+	}
+	if len(config.Organizations) > 0 && !containsAny(config.Organizations, claimValues(claims, config.OrganizationsClaim)) {
+		return forbidden(SchemeBearer, "access denied")
+	}
+	if len(config.Roles) > 0 && !containsAny(config.Roles, claimValues(claims, config.RolesClaim)) {
+		return forbidden(SchemeBearer, "access denied")
+	}
+	return nil
+}
+
+func jwtPrincipal(config JWTConfig, claims jwt.MapClaims) *Principal {
+	p := &Principal{
+		Type:          "jwt",
+		Organizations: claimValues(claims, config.OrganizationsClaim),
+		Roles:         claimValues(claims, config.RolesClaim),
+	}
+	p.Name, _ = claims["sub"].(string)
+	if p.Name == "" {
+		p.Name, _ = claims["client_id"].(string)
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		p.Scopes = strings.Fields(scope)
+	} else {
+		p.Scopes = claimValues(claims, "scp")
+	}
+	return p
+}
+
+// claimValues returns a string or string array claim as a slice
+func claimValues(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsAny(s []string, values []string) bool {
+	for _, v := range values {
+		if contains(s, v) {
+			return true
+		}
+	}
+	return false
+}
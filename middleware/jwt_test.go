@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": "key1",
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	}))
+	defer jwksServer.Close()
+
+	handler := JWTAuth(JWTConfig{
+		JWKSURL:       jwksServer.URL,
+		Issuer:        "https://iam.example.com",
+		Audiences:     []string{"gateway"},
+		Organizations: []string{"org1"},
+		Roles:         []string{"ADMIN"},
+	})
+
+	sign := func(kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+	call := func(token string) int {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":           "https://iam.example.com",
+			"aud":           []string{"gateway"},
+			"exp":           time.Now().Add(time.Hour).Unix(),
+			"organizations": []string{"org1"},
+			"roles":         "ADMIN",
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, call(sign("key1", validClaims())))
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	assert.Equal(t, http.StatusUnauthorized, call(sign("key1", expired)))
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+	assert.Equal(t, http.StatusUnauthorized, call(sign("key1", wrongIssuer)))
+
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other"
+	assert.Equal(t, http.StatusUnauthorized, call(sign("key1", wrongAudience)))
+
+	wrongOrg := validClaims()
+	wrongOrg["organizations"] = []string{"org2"}
+	assert.Equal(t, http.StatusForbidden, call(sign("key1", wrongOrg)))
+
+	assert.Equal(t, http.StatusUnauthorized, call(sign("unknown", validClaims())))
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	signed, _ := hmac.SignedString([]byte("secret"))
+	assert.Equal(t, http.StatusUnauthorized, call(signed))
+}
+
+func TestJWKSConcurrentMisses(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var fetches int32
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := []map[string]string{}
+		// The issuer rotates to key2 after the first fetch
+		for _, kid := range []string{"key1", "key2"}[:min(int(atomic.AddInt32(&fetches, 1)), 2)] {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer jwksServer.Close()
+
+	jwks, err := NewJWKS(jwksServer.URL, "", nil, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	jwks.mu.Lock()
+	jwks.lastAttempt = time.Now().Add(-2 * minJWKSRefreshOnMiss)
+	jwks.mu.Unlock()
+
+	// Concurrent requests signed with the new key wait for a single refresh
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := jwks.Key("key2")
+			assert.NoError(t, err)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// Unknown key IDs do not refetch within the retry interval
+	_, err = jwks.Key("unknown")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
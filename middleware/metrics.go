@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+)
+
+// unknownCodeID labels requests for a code which was not resolved
+const unknownCodeID = "unknown"
+
+// Metrics records request counts and latencies by route, code ID and status. The code ID
+// is only recorded once the code was resolved, see SetCodeResolved, so requests with
+// arbitrary code IDs cannot blow up the number of series
+func Metrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			status := c.Response().Status
+			route := c.Path()
+			codeID := CodeID(c)
+			if codeID != "" && !codeResolved(c) {
+				codeID = unknownCodeID
+			}
+			metrics.Requests.WithLabelValues(route, codeID, strconv.Itoa(status)).Inc()
+			metrics.RequestDuration.WithLabelValues(route, codeID).Observe(time.Since(start).Seconds())
+			return nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	e := echo.New()
+	e.Use(Metrics())
+	e.POST("/async-function/:codeID", func(c echo.Context) error {
+		if CodeID(c) != "abc" {
+			return echo.NewHTTPError(http.StatusBadGateway, "error retrieving code")
+		}
+		SetCodeResolved(c)
+		return c.NoContent(http.StatusAccepted)
+	}, TokenAuth("xxx"))
+
+	callCode := func(token, codeID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/async-function/"+codeID, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Token "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	call := func(token string) int {
+		return callCode(token, "abc")
+	}
+	accepted := metrics.Requests.WithLabelValues("/async-function/:codeID", "abc", "202")
+	rejected := metrics.Requests.WithLabelValues("/async-function/:codeID", "unknown", "401")
+	unresolved := metrics.Requests.WithLabelValues("/async-function/:codeID", "unknown", "502")
+	failures := metrics.AuthFailures.WithLabelValues("401")
+	before := []float64{testutil.ToFloat64(accepted), testutil.ToFloat64(rejected), testutil.ToFloat64(failures), testutil.ToFloat64(unresolved)}
+
+	assert.Equal(t, http.StatusAccepted, call("xxx"))
+	assert.Equal(t, http.StatusUnauthorized, call("wrong"))
+	assert.Equal(t, http.StatusBadGateway, callCode("xxx", "random"))
+	assert.Equal(t, before[0]+1, testutil.ToFloat64(accepted))
+	assert.Equal(t, before[1]+1, testutil.ToFloat64(rejected), "code IDs of rejected requests are not recorded")
+	assert.Equal(t, before[2]+1, testutil.ToFloat64(failures))
+	assert.Equal(t, before[3]+1, testutil.ToFloat64(unresolved), "code IDs which were not resolved are not recorded")
+}
@@ -4,9 +4,12 @@ import "github.com/labstack/echo/v4"
 
 // NoneAuth implements no auth
 func NoneAuth() echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			return next(c)
-		}
+	return Authenticate(NoneAuthenticator())
+}
+
+// NoneAuthenticator accepts every request as anonymous
+func NoneAuthenticator() Authenticator {
+	return func(c echo.Context) (*Principal, error) {
+		return &Principal{Type: "none", Name: "anonymous"}, nil
 	}
 }
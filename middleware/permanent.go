@@ -9,8 +9,7 @@ import (
 func permanentError(err error) func(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			_ = c.String(http.StatusInternalServerError, err.Error())
-			return err
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error()).SetInternal(err)
 		}
 	}
 }
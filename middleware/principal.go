@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	principalKey = "principal"
+)
+
+type principalContextKey struct{}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// Type is the authentication method which produced the principal
+	Type          string   `json:"type"`
+	Name          string   `json:"name"`
+	Organizations []string `json:"organizations,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	Scopes        []string `json:"scopes,omitempty"`
+}
+
+// HasScope reports whether the principal was granted scope
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && contains(p.Scopes, scope)
+}
+
+// String identifies the principal as "type:name", or is empty for a nil principal
+func (p *Principal) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Type + ":" + p.Name
+}
+
+// SetPrincipal stores the principal in the echo context and in the request context,
+// so it is also available to the proxy transport
+func SetPrincipal(c echo.Context, p *Principal) {
+	c.Set(principalKey, p)
+	req := c.Request()
+	c.SetRequest(req.WithContext(context.WithValue(req.Context(), principalContextKey{}, p)))
+}
+
+// GetPrincipal returns the principal of the request or nil when unauthenticated
+func GetPrincipal(c echo.Context) *Principal {
+	if p, ok := c.Get(principalKey).(*Principal); ok {
+		return p
+	}
+	return PrincipalFromContext(c.Request().Context())
+}
+
+// PrincipalFromContext returns the principal stored in a request context
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/patrickmn/go-cache"
+	signer "github.com/philips-software/go-hsdp-signer"
+)
+
+const (
+	defaultMaxClockSkew = 5 * time.Minute
+)
+
+// SignedKey is a shared key and secret pair of an HSDP API signing caller
+type SignedKey struct {
+	Name         string   `json:"name" yaml:"name"`
+	SharedKey    string   `json:"shared_key" yaml:"shared_key"`
+	SharedSecret string   `json:"shared_secret" yaml:"shared_secret"`
+	Scopes       []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// SignedConfig configures HSDP API signature validation
+type SignedConfig struct {
+	Keys []SignedKey `json:"keys" yaml:"keys"`
+	// MaxClockSkew is the allowed difference between SignedDate and now. Defaults to 5m
+	MaxClockSkew time.Duration `json:"max_clock_skew,omitempty" yaml:"max_clock_skew,omitempty"`
+	// RequiredParts must be covered by the signature, e.g. "method", "param" or "body"
+	RequiredParts []string `json:"required_parts,omitempty" yaml:"required_parts,omitempty"`
+}
+
+// SignedAuth implements HSDP API signature (HMAC) authorization. A signed request is
+// accepted once within the clock skew window to prevent replays
+func SignedAuth(config SignedConfig) echo.MiddlewareFunc {
+	authenticator, err := SignedAuthenticator(config)
+	if err != nil {
+		return permanentError(err)
+	}
+	return Authenticate(authenticator)
+}
+
+// SignedAuthenticator validates HSDP API signatures against the configured shared keys
+func SignedAuthenticator(config SignedConfig) (Authenticator, error) {
+	if config.MaxClockSkew <= 0 {
+		config.MaxClockSkew = defaultMaxClockSkew
+	}
+	keys := make(map[string]SignedKey)
+	signers := make(map[string]*signer.Signer)
+	for _, k := range config.Keys {
+		s, err := signer.New(k.SharedKey, k.SharedSecret)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", k.Name, err)
+		}
+		keys[k.SharedKey] = k
+		signers[k.SharedKey] = s
+	}
+	seen := cache.New(2*config.MaxClockSkew, 4*config.MaxClockSkew)
+
+	return func(c echo.Context) (*Principal, error) {
+		req := c.Request()
+		signature := req.Header.Get(signer.HeaderAuthorization)
+		if signature == "" {
+			return nil, missingCredentials(SchemeSigned, "missing signature")
+		}
+		sharedKey, err := signer.GetSharedKey(req)
+		if err != nil {
+			return nil, unauthorized(SchemeSigned, "invalid signature")
+		}
+		s, ok := signers[sharedKey]
+		if !ok {
+			return nil, unauthorized(SchemeSigned, "unknown credential")
+		}
+		if err := validateSignedDate(req.Header.Get(signer.HeaderSignedDate), config.MaxClockSkew); err != nil {
+			return nil, unauthorized(SchemeSigned, err.Error())
+		}
+		if missing := missingSignedParts(signature, config.RequiredParts); len(missing) > 0 {
+			return nil, unauthorized(SchemeSigned, "signature must cover "+strings.Join(missing, ", "))
+		}
+		if valid, _ := s.ValidateRequest(req); !valid {
+			return nil, unauthorized(SchemeSigned, "invalid signature")
+		}
+		replay, err := replayKey(req, signature)
+		if err != nil {
+			return nil, unauthorized(SchemeSigned, "unreadable request body")
+		}
+		if err := seen.Add(replay, true, cache.DefaultExpiration); err != nil {
+			return nil, unauthorized(SchemeSigned, "replayed signature")
+		}
+		key := keys[sharedKey]
+		return &Principal{Type: "signed", Name: key.Name, Scopes: key.Scopes}, nil
+	}, nil
+}
+
+// replayKey identifies a signed request by its signature, method, target and body. A signature
+// only needs to cover the signed date, so requests of a key within the same second may share it
+func replayKey(req *http.Request, signature string) (string, error) {
+	h := sha256.New()
+	_, _ = io.WriteString(h, signature+"\n"+req.Method+" "+req.URL.RequestURI()+"\n")
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func validateSignedDate(signedDate string, maxSkew time.Duration) error {
+	signed, err := time.Parse(signer.TimeFormat, signedDate)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", signer.HeaderSignedDate)
+	}
+	skew := time.Since(signed)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxSkew {
+		return fmt.Errorf("%s outside of allowed clock skew", signer.HeaderSignedDate)
+	}
+	return nil
+}
+
+// missingSignedParts returns the required parts not listed in the SignedHeaders of a signature
+func missingSignedParts(signature string, required []string) []string {
+	var signed []string
+	for _, comp := range strings.Split(signature, ";") {
+		if strings.HasPrefix(comp, "SignedHeaders:") {
+			signed = strings.Split(strings.TrimPrefix(comp, "SignedHeaders:"), ",")
+		}
+	}
+	var missing []string
+	for _, part := range required {
+		if !contains(signed, part) {
+			missing = append(missing, part)
+		}
+	}
+	return missing
+}
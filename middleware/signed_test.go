@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	signer "github.com/philips-software/go-hsdp-signer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedAuth(t *testing.T) {
+	handler := SignedAuth(SignedConfig{
+		Keys: []SignedKey{
+			{Name: "batch", SharedKey: "shared", SharedSecret: "secret"},
+		},
+		RequiredParts: []string{"method"},
+	})
+	newRequestTo := func(target, key, secret string, now time.Time, options ...func(*signer.Signer) error) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{}`))
+		options = append(options, signer.WithNowFunc(func() time.Time { return now }))
+		s, err := signer.New(key, secret, options...)
+		assert.NoError(t, err)
+		assert.NoError(t, s.SignRequest(req))
+		return req
+	}
+	newRequest := func(key, secret string, now time.Time, options ...func(*signer.Signer) error) *http.Request {
+		return newRequestTo("/foo", key, secret, now, options...)
+	}
+	call := func(req *http.Request) int {
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := handler(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+
+	req := newRequest("shared", "secret", time.Now(), signer.SignMethod())
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(strings.NewReader(`{}`))
+	assert.Equal(t, http.StatusOK, call(req))
+	assert.Equal(t, http.StatusUnauthorized, call(replay), "signatures are single use")
+
+	// Requests of a key within the same second share the signature of the date
+	now := time.Now()
+	assert.Equal(t, http.StatusOK, call(newRequestTo("/function/1", "shared", "secret", now, signer.SignMethod())))
+	assert.Equal(t, http.StatusOK, call(newRequestTo("/function/2", "shared", "secret", now, signer.SignMethod())))
+
+	assert.Equal(t, http.StatusUnauthorized, call(newRequest("shared", "wrong", time.Now(), signer.SignMethod())))
+	assert.Equal(t, http.StatusUnauthorized, call(newRequest("unknown", "secret", time.Now(), signer.SignMethod())))
+	assert.Equal(t, http.StatusUnauthorized, call(newRequest("shared", "secret", time.Now().Add(10*time.Minute), signer.SignMethod())))
+	assert.Equal(t, http.StatusUnauthorized, call(newRequest("shared", "secret", time.Now())), "method must be signed")
+	assert.Equal(t, http.StatusUnauthorized, call(httptest.NewRequest(http.MethodPost, "/foo", nil)))
+}
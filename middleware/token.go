@@ -2,23 +2,41 @@ package middleware
 
 import (
 	"fmt"
-	"net/http"
 
 	"github.com/labstack/echo/v4"
 )
 
 // TokenAuth implements token auth
 func TokenAuth(authToken string) echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			authHeader := c.Request().Header.Get("Authorization")
-			var token string
-			_, _ = fmt.Sscanf(authHeader, "Token %s", &token)
-			if authToken != token {
-				_ = c.String(http.StatusUnauthorized, "invalid token")
-				return fmt.Errorf("invalid token")
-			}
-			return next(c)
+	store := NewTokenStore()
+	if err := store.Add("token", authToken, AllScopes...); err != nil {
+		return permanentError(err)
+	}
+	return TokenStoreAuth(store)
+}
+
+// TokenStoreAuth implements token auth against a token store. When scopes
+// are given the token must have been granted at least one of them
+func TokenStoreAuth(store *TokenStore, scopes ...string) echo.MiddlewareFunc {
+	return Authenticate(TokenAuthenticator(store, scopes...))
+}
+
+// TokenAuthenticator authenticates "Token" authorization headers against a token store
+func TokenAuthenticator(store *TokenStore, scopes ...string) Authenticator {
+	return func(c echo.Context) (*Principal, error) {
+		authHeader := c.Request().Header.Get("Authorization")
+		var token string
+		_, _ = fmt.Sscanf(authHeader, "Token %s", &token)
+		if token == "" {
+			return nil, missingCredentials(SchemeToken, "missing token")
+		}
+		stored, ok := store.Lookup(token)
+		if !ok {
+			return nil, unauthorized(SchemeToken, "invalid token")
+		}
+		if len(scopes) > 0 && !containsAny(stored.Scopes, scopes) {
+			return nil, forbidden(SchemeToken, "insufficient scope")
 		}
+		return &Principal{Type: "token", Name: stored.Name, Scopes: stored.Scopes}, nil
 	}
 }
@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes
+const (
+	ScopeInvokeSync  = "invoke:sync"
+	ScopeInvokeAsync = "invoke:async"
+	ScopePayloadRead = "payload:read"
+	ScopeAdmin       = "admin"
+)
+
+// AllScopes are granted to the legacy AUTH_TOKEN_TOKEN
+var AllScopes = []string{ScopeInvokeSync, ScopeInvokeAsync, ScopePayloadRead, ScopeAdmin}
+
+const hashPrefix = "sha256"
+
+// StoredToken is a named token. Only a salted hash of the token is stored
+type StoredToken struct {
+	Name      string     `json:"name" yaml:"name"`
+	Hash      string     `json:"hash" yaml:"hash"`
+	Scopes    []string   `json:"scopes" yaml:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" yaml:"expires_at,omitempty"`
+}
+
+// Expired reports whether the token expired
+func (t StoredToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// TokenStore holds multiple named tokens, optionally loaded from a file which
+// is reloaded when it changes so tokens can be rotated with overlap
+type TokenStore struct {
+	file string
+
+	mu      sync.RWMutex
+	static  []StoredToken
+	tokens  []StoredToken
+	modTime time.Time
+}
+
+type tokenFile struct {
+	Tokens []StoredToken `json:"tokens"`
+}
+
+// HashToken returns a salted hash of token suitable for a token store
+func HashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashPrefix + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedHash(salt, token)), nil
+}
+
+func saltedHash(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// verifyToken compares token against a stored hash in constant time
+func verifyToken(hash, token string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != hashPrefix {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(expected, saltedHash(salt, token)) == 1
+}
+
+// NewTokenStore returns an empty token store
+func NewTokenStore() *TokenStore {
+	return &TokenStore{}
+}
+
+// ParseTokenStore returns a token store holding the tokens of a JSON document
+// of the form {"tokens":[{"name":"...","hash":"...","scopes":["..."]}]}
+func ParseTokenStore(data []byte) (*TokenStore, error) {
+	tokens, err := parseTokens(data)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenStore{tokens: tokens}, nil
+}
+
+// LoadTokenStoreFile returns a token store backed by a JSON file
+func LoadTokenStoreFile(path string) (*TokenStore, error) {
+	s := &TokenStore{file: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewTokenStoreWithTokens returns a token store holding already hashed tokens
+func NewTokenStoreWithTokens(tokens []StoredToken) (*TokenStore, error) {
+	if err := validateTokens(tokens); err != nil {
+		return nil, err
+	}
+	return &TokenStore{tokens: tokens}, nil
+}
+
+func parseTokens(data []byte) ([]StoredToken, error) {
+	var f tokenFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid token store: %w", err)
+	}
+	if err := validateTokens(f.Tokens); err != nil {
+		return nil, err
+	}
+	return f.Tokens, nil
+}
+
+func validateTokens(tokens []StoredToken) error {
+	for _, t := range tokens {
+		if t.Name == "" {
+			return fmt.Errorf("invalid token store: token without name")
+		}
+		if !strings.HasPrefix(t.Hash, hashPrefix+"$") {
+			return fmt.Errorf("invalid token store: token %s has no %s hash", t.Name, hashPrefix)
+		}
+	}
+	return nil
+}
+
+// Add adds a token which survives reloads of the store file
+func (s *TokenStore) Add(name, token string, scopes ...string) error {
+	hash, err := HashToken(token)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.static = append(s.static, StoredToken{Name: name, Hash: hash, Scopes: scopes})
+	return nil
+}
+
+// Reload rereads the store file when it changed since the last load
+func (s *TokenStore) Reload() error {
+	if s.file == "" {
+		return nil
+	}
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	tokens, err := parseTokens(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = tokens
+	s.modTime = info.ModTime()
+	slog.Info("loaded token store", "tokens", len(tokens), "file", s.file)
+	return nil
+}
+
+// Watch reloads the store file every interval until stop is called
+func (s *TokenStore) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.Reload(); err != nil {
+					slog.Error("error reloading token store", "file", s.file, "error", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// Lookup returns the unexpired stored token matching token. Every stored
+// token is compared so the duration does not depend on which one matches
+func (s *TokenStore) Lookup(token string) (*StoredToken, bool) {
+	if token == "" {
+		return nil, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *StoredToken
+	for _, tokens := range [][]StoredToken{s.static, s.tokens} {
+		for i := range tokens {
+			if verifyToken(tokens[i].Hash, token) && found == nil && !tokens[i].Expired() {
+				t := tokens[i]
+				found = &t
+			}
+		}
+	}
+	return found, found != nil
+}
+
+// Len returns the number of tokens in the store
+func (s *TokenStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.static) + len(s.tokens)
+}
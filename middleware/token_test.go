@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -26,3 +30,61 @@ func TestTokenAuth(t *testing.T) {
 	})
 	assert.NoError(t, f(c))
 }
+
+func TestTokenStoreAuth(t *testing.T) {
+	hash := func(token string) string {
+		h, err := HashToken(token)
+		assert.NoError(t, err)
+		return h
+	}
+	expired := time.Now().Add(-time.Hour)
+	storeFile := filepath.Join(t.TempDir(), "tokens.json")
+	writeStore := func(tokens ...StoredToken) {
+		data, _ := json.Marshal(tokenFile{Tokens: tokens})
+		assert.NoError(t, os.WriteFile(storeFile, data, 0600))
+	}
+	writeStore(
+		StoredToken{Name: "batch", Hash: hash("batch-token"), Scopes: []string{ScopeInvokeAsync}},
+		StoredToken{Name: "old", Hash: hash("old-token"), Scopes: AllScopes, ExpiresAt: &expired},
+	)
+	store, err := LoadTokenStoreFile(storeFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	call := func(token string, scopes ...string) (int, *Principal) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(`{}`))
+		req.Header.Set(echo.HeaderAuthorization, "Token "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if err := TokenStoreAuth(store, scopes...)(func(c echo.Context) error {
+			return c.String(http.StatusOK, "test")
+		})(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code, GetPrincipal(c)
+	}
+
+	code, principal := call("batch-token", ScopeInvokeAsync)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.NotNil(t, principal) {
+		assert.Equal(t, "batch", principal.Name)
+	}
+	code, _ = call("batch-token", ScopeInvokeSync)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = call("old-token")
+	assert.Equal(t, http.StatusUnauthorized, code, "expired tokens are rejected")
+	code, _ = call("")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// Rotate: the new token is added and the old one removed
+	writeStore(StoredToken{Name: "batch-v2", Hash: hash("new-token"), Scopes: []string{ScopeInvokeAsync}})
+	future := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(storeFile, future, future))
+	assert.NoError(t, store.Reload())
+	code, _ = call("new-token", ScopeInvokeAsync)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call("batch-token", ScopeInvokeAsync)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
@@ -0,0 +1,261 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/patrickmn/go-cache"
+	"github.com/philips-labs/hsdp-funcion-gateway/audit"
+	"github.com/philips-labs/hsdp-funcion-gateway/logging"
+	"github.com/philips-labs/hsdp-funcion-gateway/metrics"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-software/go-hsdp-api/iron"
+)
+
+// ErrCodeNotFound is returned when the requested code does not exist
+var ErrCodeNotFound = errors.New("code not found")
+
+// publicRefreshInterval is how long the allowlist of public functions is reused
+const publicRefreshInterval = 1 * time.Minute
+
+// Resolver finds the policy of a code. Policies in the store take precedence
+// over a "policy" declared in the sync or async schedule payload of the code
+type Resolver struct {
+	client *iron.Client
+	cache  *cache.Cache
+
+	mu    sync.RWMutex
+	store *Store
+
+	// public is the allowlist of public code IDs, loaded at most once per publicRefreshInterval
+	publicMu       sync.Mutex
+	public         map[string]bool
+	publicLoadedAt time.Time
+}
+
+// NewResolver returns a resolver. store may be nil
+func NewResolver(client *iron.Client, store *Store) *Resolver {
+	return &Resolver{
+		client: client,
+		store:  store,
+		cache:  cache.New(1*time.Minute, 2*time.Minute),
+	}
+}
+
+// SetStore replaces the policy store, e.g. on a configuration reload
+func (r *Resolver) SetStore(store *Store) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store = store
+	r.cache.Flush()
+	r.publicMu.Lock()
+	defer r.publicMu.Unlock()
+	r.publicLoadedAt = time.Time{}
+}
+
+// CacheSize returns the number of cached policy resolutions
+func (r *Resolver) CacheSize() int {
+	return r.cache.ItemCount()
+}
+
+func (r *Resolver) lookup(key string) (*Policy, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.store.Lookup(key)
+}
+
+// resolution is a cached outcome of Resolve, including codes which do not exist
+type resolution struct {
+	policy *Policy
+	err    error
+}
+
+// Resolve returns the policy of codeID or nil when no policy applies.
+// ErrCodeNotFound is returned, and cached, when the code does not exist
+func (r *Resolver) Resolve(codeID string) (*Policy, error) {
+	if p, ok := r.lookup(codeID); ok {
+		return p, nil
+	}
+	if cached, found := r.cache.Get(codeID); found {
+		res := cached.(resolution)
+		return res.policy, res.err
+	}
+	start := time.Now()
+	code, resp, err := r.client.Codes.GetCode(codeID)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		metrics.ObserveIron("get_code", start, nil)
+		r.cache.Set(codeID, resolution{err: ErrCodeNotFound}, cache.DefaultExpiration)
+		return nil, ErrCodeNotFound
+	}
+	if err == nil && resp != nil && resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("Iron returned %s", resp.Status)
+	}
+	metrics.ObserveIron("get_code", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving code: %w", err)
+	}
+	p, ok := r.lookup(code.Name)
+	if !ok {
+		p, err = r.schedulePolicy(code.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.cache.Set(codeID, resolution{policy: p}, cache.DefaultExpiration)
+	return p, nil
+}
+
+// Public reports whether codeID is a public function. It never calls Iron for codeID, the
+// allowlist of public functions is loaded for all codes at once and reused for a while
+func (r *Resolver) Public(codeID string) bool {
+	if p, ok := r.lookup(codeID); ok {
+		return p.Public
+	}
+	r.publicMu.Lock()
+	defer r.publicMu.Unlock()
+	if time.Since(r.publicLoadedAt) >= publicRefreshInterval {
+		// A failed load is retried after the interval, keeping the previous allowlist
+		r.publicLoadedAt = time.Now()
+		public, err := r.loadPublic()
+		if err != nil {
+			slog.Warn("error loading public functions", "error", err)
+		} else {
+			r.public = public
+		}
+	}
+	return r.public[codeID]
+}
+
+// loadPublic returns the IDs of the codes with a public policy
+func (r *Resolver) loadPublic() (map[string]bool, error) {
+	start := time.Now()
+	codes, resp, err := r.client.Codes.GetCodes()
+	if err == nil && resp != nil && resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("Iron returned %s", resp.Status)
+	}
+	metrics.ObserveIron("get_codes", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving codes: %w", err)
+	}
+	start = time.Now()
+	schedules, resp, err := r.client.Schedules.GetSchedules()
+	if err == nil && resp != nil && resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("Iron returned %s", resp.Status)
+	}
+	metrics.ObserveIron("get_schedules", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving schedules: %w", err)
+	}
+	public := make(map[string]bool)
+	for _, code := range *codes {
+		p, ok := r.lookup(code.ID)
+		if !ok {
+			p, ok = r.lookup(code.Name)
+		}
+		if !ok {
+			p = payloadPolicy(code.Name, *schedules)
+		}
+		if p != nil && p.Public {
+			public[code.ID] = true
+		}
+	}
+	return public, nil
+}
+
+func (r *Resolver) schedulePolicy(codeName string) (*Policy, error) {
+	start := time.Now()
+	schedules, _, err := r.client.Schedules.GetSchedulesWithCode(codeName)
+	metrics.ObserveIron("get_schedules", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving schedule: %w", err)
+	}
+	return payloadPolicy(codeName, *schedules), nil
+}
+
+// payloadPolicy returns the policy declared in the sync or async schedule of codeName, if any
+func payloadPolicy(codeName string, schedules []iron.Schedule) *Policy {
+	for _, s := range schedules {
+		if s.CodeName != codeName {
+			continue
+		}
+		var payload struct {
+			Type   string  `json:"type"`
+			Policy *Policy `json:"policy,omitempty"`
+		}
+		if err := json.Unmarshal([]byte(s.Payload), &payload); err != nil {
+			continue
+		}
+		if payload.Type != "sync" && payload.Type != "async" {
+			continue
+		}
+		if payload.Policy != nil {
+			if payload.Policy.Name == "" {
+				payload.Policy.Name = codeName
+			}
+			return payload.Policy
+		}
+	}
+	return nil
+}
+
+// Enforce authenticates requests and evaluates the principal against the policy of the
+// requested code, after limit. Public functions on the allowlist skip auth, any other
+// policy is only resolved for authenticated requests, so anonymous requests never reach
+// Iron for a code ID. limit may be nil
+func Enforce(resolver *Resolver, auth echo.MiddlewareFunc, limit echo.MiddlewareFunc) echo.MiddlewareFunc {
+	if limit == nil {
+		limit = func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		limited := limit(next)
+		authenticated := auth(limited)
+		evaluated := auth(limit(func(c echo.Context) error {
+			codeID := mw.CodeID(c)
+			p, err := resolver.Resolve(codeID)
+			if errors.Is(err, ErrCodeNotFound) {
+				return echo.NewHTTPError(http.StatusNotFound, "function not found")
+			}
+			if err != nil {
+				logging.FromContext(c.Request().Context()).Error("error resolving policy", "code_id", codeID, "error", err)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "unable to resolve access policy")
+			}
+			mw.SetCodeResolved(c)
+			if p == nil {
+				return next(c)
+			}
+			if err := p.Evaluate(mw.GetPrincipal(c)); err != nil {
+				event := audit.Request(c, audit.EventAuth)
+				event.Principal = mw.GetPrincipal(c).String()
+				event.CodeID = codeID
+				event.Decision = audit.DecisionDeny
+				event.Status = http.StatusForbidden
+				event.Reason = err.Error()
+				audit.FromContext(c.Request().Context()).Log(event)
+				return echo.NewHTTPError(http.StatusForbidden, err.Error())
+			}
+			return next(c)
+		}))
+		return func(c echo.Context) error {
+			codeID := mw.CodeID(c)
+			if codeID == "" {
+				return authenticated(c)
+			}
+			if resolver.Public(codeID) {
+				event := audit.Request(c, audit.EventAuth)
+				event.CodeID = codeID
+				event.Decision = audit.DecisionAllow
+				event.Reason = "public function"
+				audit.FromContext(c.Request().Context()).Log(event)
+				mw.SetCodeResolved(c)
+				return limited(c)
+			}
+			return evaluated(c)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+)
+
+// Policy restricts access to a function. An empty list places no restriction
+// on that attribute. A principal needs one of the listed organizations, one
+// of the listed roles and one of the listed scopes
+type Policy struct {
+	Name          string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Public        bool     `json:"public,omitempty" yaml:"public,omitempty"`
+	Organizations []string `json:"organizations,omitempty" yaml:"organizations,omitempty"`
+	Roles         []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Scopes        []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+}
+
+// DeniedError explains why a policy denied access
+type DeniedError struct {
+	Policy string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("access denied by policy %s: %s", e.Policy, e.Reason)
+}
+
+// Evaluate returns a DeniedError when the principal does not satisfy the policy
+func (p Policy) Evaluate(principal *mw.Principal) error {
+	if p.Public {
+		return nil
+	}
+	if principal == nil {
+		return p.denied("not authenticated")
+	}
+	if len(p.Organizations) > 0 && !containsAny(p.Organizations, principal.Organizations) {
+		return p.denied("requires one of organizations " + strings.Join(p.Organizations, ", "))
+	}
+	if len(p.Roles) > 0 && !containsAny(p.Roles, principal.Roles) {
+		return p.denied("requires one of roles " + strings.Join(p.Roles, ", "))
+	}
+	if len(p.Scopes) > 0 && !containsAny(p.Scopes, principal.Scopes) {
+		return p.denied("requires one of scopes " + strings.Join(p.Scopes, ", "))
+	}
+	return nil
+}
+
+func (p Policy) denied(reason string) error {
+	name := p.Name
+	if name == "" {
+		name = "(unnamed)"
+	}
+	return &DeniedError{Policy: name, Reason: reason}
+}
+
+// Store holds policies keyed by code ID or code name
+type Store struct {
+	Policies map[string]Policy `json:"policies"`
+}
+
+// LoadFile reads a JSON policy file of the form {"policies":{"<code ID or name>":{...}}}
+func LoadFile(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var store Store
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	for key, p := range store.Policies {
+		if p.Name == "" {
+			p.Name = key
+			store.Policies[key] = p
+		}
+	}
+	return &store, nil
+}
+
+// Lookup returns the policy for a code ID or name
+func (s *Store) Lookup(key string) (*Policy, bool) {
+	if s == nil {
+		return nil, false
+	}
+	p, ok := s.Policies[key]
+	if !ok {
+		return nil, false
+	}
+	return &p, true
+}
+
+func containsAny(s []string, values []string) bool {
+	for _, v := range values {
+		for _, a := range s {
+			if a == v {
+				return true
+			}
+		}
+	}
+	return false
+}
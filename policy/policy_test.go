@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/philips-software/go-hsdp-api/iron"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	muxIRON    *http.ServeMux
+	serverIRON *httptest.Server
+	client     *iron.Client
+	projectID  = "48a0183d-a588-41c2-9979-737d15e9e860"
+	token      = "YM7eZakYwqoui5znoH4g"
+)
+
+func setup(t *testing.T) func() {
+	muxIRON = http.NewServeMux()
+	serverIRON = httptest.NewServer(muxIRON)
+
+	var err error
+
+	client, err = iron.NewClient(&iron.Config{
+		BaseURL:   serverIRON.URL,
+		ProjectID: projectID,
+		Token:     token,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, client)
+
+	return func() {
+		serverIRON.Close()
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p := Policy{Name: "admins", Organizations: []string{"org1"}, Roles: []string{"ADMIN"}}
+
+	assert.NoError(t, p.Evaluate(&mw.Principal{Organizations: []string{"org1"}, Roles: []string{"ADMIN"}}))
+	err := p.Evaluate(&mw.Principal{Organizations: []string{"org1"}, Roles: []string{"USER"}})
+	if assert.Error(t, err) {
+		assert.Equal(t, "access denied by policy admins: requires one of roles ADMIN", err.Error())
+	}
+	assert.Error(t, p.Evaluate(nil))
+	assert.NoError(t, Policy{Public: true}.Evaluate(nil))
+}
+
+func TestEnforce(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	for _, code := range []struct{ id, name string }{{"1", "public"}, {"2", "admins"}, {"3", "open"}} {
+		code := code
+		muxIRON.HandleFunc(client.Path("projects", projectID, "codes", code.id), func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, `{"id":"`+code.id+`","name":"`+code.name+`"}`)
+		})
+	}
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"codes":[{"id":"1","name":"public"},{"id":"2","name":"admins"},{"id":"3","name":"open"},{"id":"4","name":"declared"}]}`)
+	})
+	lookups := 0
+	muxIRON.HandleFunc(client.Path("projects", projectID, "codes", "9"), func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"msg":"Code not found"}`)
+	})
+	muxIRON.HandleFunc(client.Path("projects", projectID, "schedules"), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, `{"schedules":[
+  {"id":"s1","code_name":"admins","payload":"{\"type\":\"sync\",\"policy\":{\"roles\":[\"ADMIN\"]}}"},
+  {"id":"s2","code_name":"open","payload":"{\"type\":\"sync\"}"},
+  {"id":"s3","code_name":"declared","payload":"{\"type\":\"async\",\"policy\":{\"public\":true}}"}
+]}`)
+	})
+
+	policyFile := filepath.Join(t.TempDir(), "policies.json")
+	assert.NoError(t, os.WriteFile(policyFile, []byte(`{"policies":{"public":{"public":true}}}`), 0600))
+	store, err := LoadFile(policyFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var roles []string
+	auth := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if roles == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+			}
+			mw.SetPrincipal(c, &mw.Principal{Type: "test", Roles: roles})
+			return next(c)
+		}
+	}
+	e := echo.New()
+	e.POST("/async-function/:codeID", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, Enforce(NewResolver(client, store), auth, nil))
+
+	call := func(codeID string) int {
+		req := httptest.NewRequest(http.MethodPost, "/async-function/"+codeID, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	roles = nil
+	assert.Equal(t, http.StatusOK, call("1"), "public functions skip auth")
+	assert.Equal(t, http.StatusOK, call("4"), "public functions may be declared in the schedule")
+	assert.Equal(t, http.StatusUnauthorized, call("2"))
+	assert.Equal(t, http.StatusUnauthorized, call("3"))
+	assert.Equal(t, http.StatusUnauthorized, call("9"))
+	assert.Equal(t, 0, lookups, "anonymous requests do not look up codes")
+
+	roles = []string{"USER"}
+	assert.Equal(t, http.StatusForbidden, call("2"))
+	assert.Equal(t, http.StatusOK, call("3"))
+
+	roles = []string{"ADMIN"}
+	assert.Equal(t, http.StatusOK, call("2"))
+	assert.Equal(t, http.StatusNotFound, call("9"))
+	assert.Equal(t, http.StatusNotFound, call("9"))
+	assert.Equal(t, 1, lookups, "missing codes are cached")
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+)
+
+// Rate limit response headers
+const (
+	HeaderLimit          = "X-RateLimit-Limit"
+	HeaderRemaining      = "X-RateLimit-Remaining"
+	HeaderReset          = "X-RateLimit-Reset"
+	HeaderQuotaLimit     = "X-RateLimit-Quota-Limit"
+	HeaderQuotaRemaining = "X-RateLimit-Quota-Remaining"
+	HeaderQuotaReset     = "X-RateLimit-Quota-Reset"
+)
+
+// PrincipalKey identifies the principal of a request as "type:name". Requests
+// without a principal, e.g. to public functions, are keyed by client IP
+func PrincipalKey(c echo.Context) string {
+	if p := mw.GetPrincipal(c); p != nil {
+		return p.String()
+	}
+	return "ip:" + c.RealIP()
+}
+
+// Middleware limits requests by authenticated principal. It must run after authentication
+func Middleware(limiter *Limiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			config := limiter.Config()
+			principal := PrincipalKey(c)
+			limit := config.LimitFor(principal)
+			if limit.Rate <= 0 && limit.DailyQuota <= 0 {
+				return next(c)
+			}
+			key := principal
+			if config.PerFunction {
+				key += "/" + mw.CodeID(c)
+			}
+			d := limiter.Allow(key, limit)
+			setHeaders(c.Response().Header(), d)
+			if !d.Allowed {
+				c.Response().Header().Set(echo.HeaderRetryAfter, seconds(d.RetryAfter))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+func setHeaders(h http.Header, d Decision) {
+	if d.Limit > 0 {
+		h.Set(HeaderLimit, strconv.Itoa(d.Limit))
+		h.Set(HeaderRemaining, strconv.Itoa(d.Remaining))
+		h.Set(HeaderReset, seconds(d.Reset))
+	}
+	if d.Quota > 0 {
+		h.Set(HeaderQuotaLimit, strconv.Itoa(d.Quota))
+		h.Set(HeaderQuotaRemaining, strconv.Itoa(d.QuotaRemaining))
+		h.Set(HeaderQuotaReset, seconds(d.QuotaReset))
+	}
+}
+
+// seconds rounds d up to whole seconds
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
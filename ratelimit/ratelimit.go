@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// bucketIdleTTL is how long the token bucket of an idle key is kept
+	bucketIdleTTL  = time.Hour
+	saveInterval   = 10 * time.Second
+	quotaDayFormat = "2006-01-02"
+)
+
+// Limit is a token bucket of Rate requests per second with Burst capacity and a
+// daily invocation quota. Zero values are unlimited
+type Limit struct {
+	Rate       float64 `json:"rate,omitempty" yaml:"rate,omitempty"`
+	Burst      int     `json:"burst,omitempty" yaml:"burst,omitempty"`
+	DailyQuota int     `json:"daily_quota,omitempty" yaml:"daily_quota,omitempty"`
+}
+
+// Config configures rate limits keyed by principal
+type Config struct {
+	Default Limit `json:"default" yaml:"default"`
+	// Principals override the default limit, keyed by principal type and name, e.g. "token:batch"
+	Principals map[string]Limit `json:"principals,omitempty" yaml:"principals,omitempty"`
+	// PerFunction limits each principal separately per function
+	PerFunction bool `json:"per_function,omitempty" yaml:"per_function,omitempty"`
+	// StateFile persists the daily quota counters. Counters are kept in memory when empty
+	StateFile string `json:"state_file,omitempty" yaml:"state_file,omitempty"`
+}
+
+// LimitFor returns the limit of a principal key
+func (c Config) LimitFor(principal string) Limit {
+	if limit, ok := c.Principals[principal]; ok {
+		return limit
+	}
+	return c.Default
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed bool
+	// Limit, Remaining and Reset describe the token bucket
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+	// Quota, QuotaRemaining and QuotaReset describe the daily quota
+	Quota          int
+	QuotaRemaining int
+	QuotaReset     time.Duration
+	// RetryAfter is set when the request is not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter enforces rate limits and daily quotas
+type Limiter struct {
+	buckets   *cache.Cache
+	stateFile string
+
+	mu     sync.Mutex
+	config Config
+	day    string
+	used   map[string]int
+	dirty  bool
+	// changes counts the changes of used, so a save only clears dirty when nothing changed meanwhile
+	changes uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns a limiter. Quota counters of the current day are loaded from the state file
+func New(config Config) (*Limiter, error) {
+	l := &Limiter{
+		config:    config,
+		stateFile: config.StateFile,
+		buckets:   cache.New(bucketIdleTTL, bucketIdleTTL/2),
+		day:       time.Now().UTC().Format(quotaDayFormat),
+		used:      make(map[string]int),
+		stop:      make(chan struct{}),
+	}
+	if err := l.loadState(); err != nil {
+		return nil, fmt.Errorf("loading quota state: %w", err)
+	}
+	if config.StateFile != "" {
+		go l.saveLoop()
+	}
+	return l, nil
+}
+
+// Config returns the current configuration of the limiter
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// SetConfig replaces the limits, e.g. on a configuration reload. Token buckets
+// are recreated when their limit changed, quota counters are kept. The state
+// file is only read on start
+func (l *Limiter) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	config.StateFile = l.stateFile
+	l.config = config
+}
+
+// Allow checks and, when allowed, counts a request of key against limit
+func (l *Limiter) Allow(key string, limit Limit) Decision {
+	now := time.Now()
+	d := Decision{Allowed: true}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollover(now)
+	if limit.DailyQuota > 0 {
+		d.Quota = limit.DailyQuota
+		d.QuotaRemaining = limit.DailyQuota - l.used[key]
+		d.QuotaReset = nextDay(now).Sub(now)
+		if d.QuotaRemaining <= 0 {
+			d.Allowed = false
+			d.QuotaRemaining = 0
+			d.RetryAfter = d.QuotaReset
+			return d
+		}
+	}
+	if limit.Rate > 0 {
+		bucket := l.bucket(key, limit)
+		d.Limit = bucket.Burst()
+		if !bucket.AllowN(now, 1) {
+			r := bucket.ReserveN(now, 1)
+			d.Allowed = false
+			d.RetryAfter = r.DelayFrom(now)
+			r.CancelAt(now)
+		}
+		tokens := bucket.TokensAt(now)
+		d.Remaining = int(math.Max(0, math.Floor(tokens)))
+		d.Reset = time.Duration((float64(bucket.Burst()) - tokens) / limit.Rate * float64(time.Second))
+		if !d.Allowed {
+			return d
+		}
+	}
+	if limit.DailyQuota > 0 {
+		l.used[key]++
+		l.dirty = true
+		l.changes++
+		d.QuotaRemaining--
+	}
+	return d
+}
+
+// bucket returns the token bucket of key, must be called with l.mu held
+func (l *Limiter) bucket(key string, limit Limit) *rate.Limiter {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	if cached, ok := l.buckets.Get(key); ok {
+		bucket := cached.(*rate.Limiter)
+		if bucket.Limit() == rate.Limit(limit.Rate) && bucket.Burst() == burst {
+			l.buckets.SetDefault(key, bucket)
+			return bucket
+		}
+	}
+	bucket := rate.NewLimiter(rate.Limit(limit.Rate), burst)
+	l.buckets.SetDefault(key, bucket)
+	return bucket
+}
+
+// rollover resets the quota counters on a new day, must be called with l.mu held
+func (l *Limiter) rollover(now time.Time) {
+	if day := now.UTC().Format(quotaDayFormat); day != l.day {
+		l.day = day
+		l.used = make(map[string]int)
+		l.dirty = true
+		l.changes++
+	}
+}
+
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Used returns the quota used today by key
+func (l *Limiter) Used(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollover(time.Now())
+	return l.used[key]
+}
+
+func (l *Limiter) saveLoop() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.save(); err != nil {
+				slog.Error("error saving quota state", "file", l.stateFile, "error", err)
+			}
+		}
+	}
+}
+
+// Close stops persisting and saves the quota counters a final time
+func (l *Limiter) Close() error {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	return l.save()
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	mw "github.com/philips-labs/hsdp-funcion-gateway/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	limiter, err := New(Config{
+		Default: Limit{Rate: 0.001, Burst: 2},
+		Principals: map[string]Limit{
+			"token:batch": {DailyQuota: 3},
+		},
+		PerFunction: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer limiter.Close()
+
+	e := echo.New()
+	e.POST("/async-function/:codeID", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if name := c.Request().Header.Get("X-Test-Principal"); name != "" {
+				mw.SetPrincipal(c, &mw.Principal{Type: "token", Name: name})
+			}
+			return next(c)
+		}
+	}, Middleware(limiter))
+
+	call := func(principal, codeID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/async-function/"+codeID, nil)
+		req.Header.Set("X-Test-Principal", principal)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("token bucket", func(t *testing.T) {
+		rec := call("browser", "1")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get(HeaderLimit))
+		assert.Equal(t, "1", rec.Header().Get(HeaderRemaining))
+		assert.Equal(t, http.StatusOK, call("browser", "1").Code)
+
+		rec = call("browser", "1")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "0", rec.Header().Get(HeaderRemaining))
+		assert.NotEmpty(t, rec.Header().Get(echo.HeaderRetryAfter))
+
+		assert.Equal(t, http.StatusOK, call("browser", "2").Code, "functions are limited separately")
+		assert.Equal(t, http.StatusOK, call("other", "1").Code, "principals are limited separately")
+	})
+
+	t.Run("daily quota", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			rec := call("batch", "1")
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Empty(t, rec.Header().Get(HeaderLimit), "batch has no rate limit")
+		}
+		rec := call("batch", "1")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.Equal(t, "3", rec.Header().Get(HeaderQuotaLimit))
+		assert.Equal(t, "0", rec.Header().Get(HeaderQuotaRemaining))
+		assert.Equal(t, rec.Header().Get(HeaderQuotaReset), rec.Header().Get(echo.HeaderRetryAfter))
+	})
+}
+
+func TestQuotaState(t *testing.T) {
+	config := Config{
+		Default:   Limit{DailyQuota: 5},
+		StateFile: filepath.Join(t.TempDir(), "quota.json"),
+	}
+	limiter, err := New(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, limiter.Allow("token:batch", config.Default).Allowed)
+	assert.True(t, limiter.Allow("token:batch", config.Default).Allowed)
+	assert.NoError(t, limiter.Close())
+
+	restarted, err := New(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer restarted.Close()
+	assert.Equal(t, 2, restarted.Used("token:batch"))
+	d := restarted.Allow("token:batch", config.Default)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.QuotaRemaining)
+}
+
+func TestQuotaStateRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	config := Config{
+		Default:   Limit{DailyQuota: 5},
+		StateFile: filepath.Join(dir, "quota.json"),
+	}
+	limiter, err := New(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer limiter.Close()
+	assert.True(t, limiter.Allow("token:batch", config.Default).Allowed)
+	assert.Error(t, limiter.save(), "the state directory does not exist yet")
+
+	// The counters are still saved once the state file can be written
+	assert.NoError(t, os.MkdirAll(dir, 0700))
+	assert.NoError(t, limiter.save())
+	data, err := os.ReadFile(config.StateFile)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(data), `"token:batch":1`)
+	}
+}
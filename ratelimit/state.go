@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type state struct {
+	Day  string         `json:"day"`
+	Used map[string]int `json:"used"`
+}
+
+func (l *Limiter) loadState() error {
+	if l.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s.Day == l.day && s.Used != nil {
+		l.used = s.Used
+	}
+	return nil
+}
+
+// save writes the quota counters when they changed since the last save. The counters
+// stay dirty when the write fails, so the next save retries
+func (l *Limiter) save() error {
+	if l.stateFile == "" {
+		return nil
+	}
+	l.mu.Lock()
+	l.rollover(time.Now())
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	s := state{Day: l.day, Used: make(map[string]int, len(l.used))}
+	for key, used := range l.used {
+		s.Used[key] = used
+	}
+	changes := l.changes
+	l.mu.Unlock()
+
+	if err := l.writeState(&s); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.changes == changes {
+		l.dirty = false
+	}
+	return nil
+}
+
+func (l *Limiter) writeState(s *state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.stateFile), ".ratelimit-state-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.stateFile)
+}
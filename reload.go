@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/philips-labs/hsdp-funcion-gateway/config"
+	"github.com/philips-labs/hsdp-funcion-gateway/policy"
+	"github.com/philips-labs/hsdp-funcion-gateway/ratelimit"
+)
+
+// reloader reloads the auth settings, policies and rate limits on SIGHUP or when
+// the configuration or policy file changes. Invalid configurations are rejected
+// and the current configuration is kept
+type reloader struct {
+	path string
+	auth *authChain
+	// resolvers are the policy resolvers of the backends
+	resolvers []*policy.Resolver
+	limiter   *ratelimit.Limiter
+
+	modTimes map[string]time.Time
+}
+
+func newReloader(path string, cfg *config.Config, auth *authChain, resolvers []*policy.Resolver, limiter *ratelimit.Limiter) *reloader {
+	r := &reloader{
+		path:      path,
+		auth:      auth,
+		resolvers: resolvers,
+		limiter:   limiter,
+	}
+	r.modTimes = r.stat(cfg)
+	return r
+}
+
+// watch reloads until ctx is done
+func (r *reloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			_ = r.reload("SIGHUP")
+		case <-ticker.C:
+			if r.changed() {
+				_ = r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *reloader) reload(reason string) error {
+	cfg, err := config.Load(r.path)
+	if err == nil {
+		err = r.apply(cfg)
+	}
+	if err != nil {
+		slog.Error("configuration reload failed, keeping current configuration", "reason", reason, "error", err)
+		return err
+	}
+	r.modTimes = r.stat(cfg)
+	slog.Info("configuration reloaded", "reason", reason)
+	return nil
+}
+
+func (r *reloader) apply(cfg *config.Config) error {
+	policies, err := cfg.PolicyStore()
+	if err != nil {
+		return err
+	}
+	if err := r.auth.Reload(cfg.Auth); err != nil {
+		return err
+	}
+	for _, resolver := range r.resolvers {
+		resolver.SetStore(policies)
+	}
+	r.limiter.SetConfig(cfg.RateLimits)
+	return nil
+}
+
+// stat returns the modification times of the configuration and policy files
+func (r *reloader) stat(cfg *config.Config) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.path, cfg.PolicyFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (r *reloader) changed() bool {
+	for file, modTime := range r.modTimes {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}